@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// adaptiveThrottle adjusts the rate limit of each writer from how the writer has been responding (AIMD):
+// every interval the rate is halved if the writer was slow or returned too many transient errors, and is otherwise
+// increased by a fixed step, between minRate and maxRate. A writer with a limit set by name is left alone, and an
+// unlimited writer stays unlimited until it first struggles, when it is cut to half of maxRate.
+type adaptiveThrottle struct {
+	limiter          *rateLimiter
+	minRate          float64
+	maxRate          float64
+	increase         float64
+	burst            int
+	latencyThreshold time.Duration
+	// errorThreshold is the fraction (0 to 1) of calls that may fail with a transient error before the rate is reduced
+	errorThreshold float64
+
+	mu      sync.Mutex
+	writers map[string]*writerStats
+}
+
+// writerStats is what has been observed of a writer since the last adjustment.
+type writerStats struct {
+	// rate is 0 or less while the writer is unlimited
+	rate    float64
+	calls   int
+	errors  int
+	latency time.Duration
+	gauge   metrics.GaugeFloat64
+}
+
+func newAdaptiveThrottle(limiter *rateLimiter, minRate float64, maxRate float64, burst int, latencyThreshold time.Duration, errorThreshold float64) *adaptiveThrottle {
+	return &adaptiveThrottle{
+		limiter:          limiter,
+		minRate:          minRate,
+		maxRate:          maxRate,
+		increase:         math.Max(1, maxRate/10),
+		burst:            burst,
+		latencyThreshold: latencyThreshold,
+		errorThreshold:   errorThreshold,
+		writers:          make(map[string]*writerStats),
+	}
+}
+
+// observe records a call to a writer. A nil adaptiveThrottle ignores it.
+func (at *adaptiveThrottle) observe(writer string, latency time.Duration, err error) {
+	if at == nil {
+		return
+	}
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	stats, ok := at.writers[writer]
+	if !ok {
+		limit, overridden := at.limiter.current(writerLimit, writer)
+		if overridden {
+			return
+		}
+		stats = &writerStats{rate: limit.Rate, gauge: metrics.GetOrRegisterGaugeFloat64("throttle-"+metricSafe(writer)+"-RATE", metrics.DefaultRegistry)}
+		stats.gauge.Update(stats.rate)
+		at.writers[writer] = stats
+	}
+	stats.calls++
+	stats.latency += latency
+	if err != nil && isTransient(err) {
+		stats.errors++
+	}
+}
+
+// adjust works out the new rate of every writer from what has been observed since it was last called.
+func (at *adaptiveThrottle) adjust() {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	for writer, stats := range at.writers {
+		if _, overridden := at.limiter.current(writerLimit, writer); overridden {
+			// a limit set by name since the writer was first seen
+			delete(at.writers, writer)
+			continue
+		}
+		rate := stats.rate
+		if rate > 0 && rate < at.maxRate {
+			rate = math.Min(at.maxRate, rate+at.increase)
+		}
+		if stats.calls > 0 {
+			averageLatency := stats.latency / time.Duration(stats.calls)
+			errorRate := float64(stats.errors) / float64(stats.calls)
+			if averageLatency > at.latencyThreshold || errorRate > at.errorThreshold {
+				rate = stats.rate
+				if rate <= 0 || rate > at.maxRate {
+					rate = at.maxRate
+				}
+				rate = math.Max(at.minRate, rate/2)
+				log.Warnf("Writer %s is struggling (average latency %v, %.0f%% transient errors), reducing its rate to %v/s", writer, averageLatency, errorRate*100, rate)
+			}
+		}
+		if rate != stats.rate {
+			stats.rate = rate
+			at.limiter.adapt(writerLimit, writer, rateLimit{Rate: rate, Burst: at.burst})
+		}
+		stats.gauge.Update(rate)
+		stats.calls, stats.errors, stats.latency = 0, 0, 0
+	}
+}
+
+func (at *adaptiveThrottle) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		at.adjust()
+	}
+}
+
+// rates returns the effective rate of every writer seen so far.
+func (at *adaptiveThrottle) rates() map[string]float64 {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	rates := make(map[string]float64, len(at.writers))
+	for writer, stats := range at.writers {
+		rates[writer] = stats.rate
+	}
+	return rates
+}
+
+func (at *adaptiveThrottle) healthCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Concepts are being ingested more slowly than usual",
+		Name:             "Adaptive writer throttling",
+		PanicGuide:       "https://dewey.ft.com/concept-ingester.html",
+		Severity:         2,
+		TechnicalSummary: "One or more writers have been slow or failing, so the rate at which concepts are sent to them has been cut to the minimum. Check the health of the writers and their databases.",
+		Checker:          at.checkRates,
+	}
+}
+
+func (at *adaptiveThrottle) checkRates() (string, error) {
+	rates := at.rates()
+	writers := make([]string, 0, len(rates))
+	for writer := range rates {
+		writers = append(writers, writer)
+	}
+	sort.Strings(writers)
+
+	var effective, throttled []string
+	for _, writer := range writers {
+		if rates[writer] <= 0 {
+			effective = append(effective, writer+": unlimited")
+			continue
+		}
+		effective = append(effective, fmt.Sprintf("%s: %v/s", writer, rates[writer]))
+		if rates[writer] <= at.minRate {
+			throttled = append(throttled, writer)
+		}
+	}
+	output := strings.Join(effective, ", ")
+	if len(throttled) > 0 {
+		return output, fmt.Errorf("Writers throttled to the minimum rate of %v/s: %s", at.minRate, strings.Join(throttled, ", "))
+	}
+	return output, nil
+}
+
+// metricSafe replaces the characters of a URL that graphite would treat as separators.
+func metricSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
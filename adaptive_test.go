@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const adaptiveWriter = "http://organisations-rw-neo4j:8080"
+
+func TestAdaptiveThrottleHalvesTheRateOfAFailingWriter(t *testing.T) {
+	rl := newRateLimiter(rateLimit{}, rateLimit{})
+	at := newAdaptiveThrottle(rl, 1, 100, 1, time.Second, 0.1)
+
+	at.observe(adaptiveWriter, time.Millisecond, nil)
+	at.observe(adaptiveWriter, time.Millisecond, &writerError{status: http.StatusServiceUnavailable})
+	at.adjust()
+
+	assert.Equal(t, 50.0, at.rates()[adaptiveWriter])
+	assert.Equal(t, rateLimit{Rate: 50, Burst: 1}, rl.limits()["writer:"+adaptiveWriter])
+	assert.Equal(t, 50.0, metrics.GetOrRegisterGaugeFloat64("throttle-http___organisations-rw-neo4j_8080-RATE", metrics.DefaultRegistry).Value())
+}
+
+func TestAdaptiveThrottleHalvesTheRateOfASlowWriter(t *testing.T) {
+	at := newAdaptiveThrottle(newRateLimiter(rateLimit{}, rateLimit{}), 1, 100, 1, 100*time.Millisecond, 0.1)
+
+	at.observe(adaptiveWriter, time.Second, nil)
+	at.adjust()
+
+	assert.Equal(t, 50.0, at.rates()[adaptiveWriter])
+}
+
+func TestAdaptiveThrottleIgnoresValidationFailures(t *testing.T) {
+	at := newAdaptiveThrottle(newRateLimiter(rateLimit{}, rateLimit{}), 1, 100, 1, time.Second, 0.1)
+
+	at.observe(adaptiveWriter, time.Millisecond, &writerError{status: http.StatusBadRequest})
+	at.observe(adaptiveWriter, time.Millisecond, errors.New("cannot create request"))
+	at.adjust()
+
+	assert.Equal(t, 0.0, at.rates()[adaptiveWriter], "The writer should still be unlimited")
+}
+
+func TestAdaptiveThrottleLeavesUnlimitedWritersAloneUntilTheyStruggle(t *testing.T) {
+	rl := newRateLimiter(rateLimit{}, rateLimit{})
+	at := newAdaptiveThrottle(rl, 1, 100, 1, time.Second, 0.1)
+
+	at.observe(adaptiveWriter, time.Millisecond, nil)
+	at.adjust()
+	_, limited := rl.limits()["writer:"+adaptiveWriter]
+	assert.False(t, limited, "A healthy unlimited writer should not be limited")
+	output, err := at.checkRates()
+	assert.NoError(t, err)
+	assert.Equal(t, adaptiveWriter+": unlimited", output)
+
+	at.observe(adaptiveWriter, time.Millisecond, &writerError{})
+	at.adjust()
+	assert.Equal(t, rateLimit{Rate: 50, Burst: 1}, rl.limits()["writer:"+adaptiveWriter])
+}
+
+func TestAdaptiveThrottleKeepsLimitsSetByName(t *testing.T) {
+	rl := newRateLimiter(rateLimit{}, rateLimit{})
+	require.NoError(t, rl.set("writer:"+adaptiveWriter, rateLimit{Rate: 500, Burst: 10}))
+	at := newAdaptiveThrottle(rl, 1, 100, 1, time.Second, 0.1)
+
+	at.observe(adaptiveWriter, time.Millisecond, &writerError{})
+	at.adjust()
+	assert.Equal(t, rateLimit{Rate: 500, Burst: 10}, rl.limits()["writer:"+adaptiveWriter], "A limit from --rate-limits should not be overwritten")
+
+	other := "http://people-rw-neo4j:8080"
+	at.observe(other, time.Millisecond, &writerError{})
+	at.adjust()
+	require.NoError(t, rl.set("writer:"+other, rateLimit{Rate: 5, Burst: 1}))
+	at.observe(other, time.Millisecond, nil)
+	at.adjust()
+	assert.Equal(t, rateLimit{Rate: 5, Burst: 1}, rl.limits()["writer:"+other], "A limit from /__throttle should not be overwritten")
+}
+
+func TestAdaptiveThrottleRecoversGraduallyAndStaysWithinItsBounds(t *testing.T) {
+	at := newAdaptiveThrottle(newRateLimiter(rateLimit{}, rateLimit{}), 20, 100, 1, time.Second, 0.1)
+
+	at.observe(adaptiveWriter, time.Millisecond, &writerError{})
+	for i := 0; i < 5; i++ {
+		at.adjust()
+		at.observe(adaptiveWriter, time.Millisecond, &writerError{})
+	}
+	assert.Equal(t, 20.0, at.rates()[adaptiveWriter], "The rate should not drop below the minimum")
+	_, err := at.checkRates()
+	assert.Error(t, err, "A writer at the minimum rate should fail the health check")
+
+	at.adjust()
+	at.adjust()
+	assert.Equal(t, 30.0, at.rates()[adaptiveWriter], "The rate should go up by a tenth of the maximum at a time")
+
+	for i := 0; i < 20; i++ {
+		at.adjust()
+	}
+	assert.Equal(t, 100.0, at.rates()[adaptiveWriter], "The rate should not exceed the maximum")
+	output, err := at.checkRates()
+	assert.NoError(t, err)
+	assert.Equal(t, adaptiveWriter+": 100/s", output)
+}
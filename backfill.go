@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBackfillRecordSize is the largest line accepted in a backfill file.
+const maxBackfillRecordSize = 16 * 1024 * 1024
+
+// backfillRecord is one line of a backfill file: the headers and body of a Kafka message. Dead-letter files have the
+// same shape, so they can be backfilled too. The body is either a JSON string holding the message body or, for
+// convenience, the concept itself.
+type backfillRecord struct {
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// message turns the record into a message. The UUID is not checked here: like for a message from Kafka, it can come
+// from the Message-Id header or the body.
+func (r backfillRecord) message() (queueConsumer.Message, error) {
+	if r.Headers["Message-Type"] == "" {
+		return queueConsumer.Message{}, fmt.Errorf("Message-Type header is required")
+	}
+	body := string(r.Body)
+	if strings.HasPrefix(body, `"`) {
+		if err := json.Unmarshal(r.Body, &body); err != nil {
+			return queueConsumer.Message{}, fmt.Errorf("Invalid body: %v", err)
+		}
+	} else if body == "null" {
+		body = ""
+	}
+	return queueConsumer.Message{Headers: r.Headers, Body: body}, nil
+}
+
+// backfillSummary reports what happened to the records of a backfill.
+type backfillSummary struct {
+	Records int `json:"records"`
+	// Invalid counts the lines that are not records, e.g. malformed JSON or a missing Message-Type header
+	Invalid      int                           `json:"invalid"`
+	Delivered    int                           `json:"delivered"`
+	DeadLettered int                           `json:"deadLettered"`
+	Rejected     int                           `json:"rejected"`
+	Failed       int                           `json:"failed"`
+	Types        map[string]*backfillTypeCount `json:"types"`
+	DryRun       bool                          `json:"dryRun"`
+
+	mu sync.Mutex
+}
+
+type backfillTypeCount struct {
+	Delivered    int `json:"delivered"`
+	DeadLettered int `json:"deadLettered"`
+	Rejected     int `json:"rejected"`
+	Failed       int `json:"failed"`
+	// Destinations counts how many messages were, or in a dry run would have been, sent to each destination. Writes
+	// skipped because the destination already had the same content are not counted.
+	Destinations map[string]int `json:"destinations,omitempty"`
+}
+
+func (s *backfillSummary) typeCount(ingestionType string) *backfillTypeCount {
+	count, ok := s.Types[ingestionType]
+	if !ok {
+		count = &backfillTypeCount{Destinations: make(map[string]int)}
+		s.Types[ingestionType] = count
+	}
+	return count
+}
+
+func (s *backfillSummary) String() string {
+	verb := "delivered"
+	if s.DryRun {
+		verb = "would have been delivered"
+	}
+	return fmt.Sprintf("%d records: %d %s, %d dead-lettered, %d rejected, %d failed, %d invalid", s.Records, s.Delivered, verb, s.DeadLettered, s.Rejected, s.Failed, s.Invalid)
+}
+
+// backfillInputs expands the given paths into the files to read, in order. A directory stands for every file under
+// it, sorted by name, and "-" for stdin.
+func backfillInputs(paths []string) ([]string, error) {
+	var inputs []string
+	for _, path := range paths {
+		if path == "-" {
+			inputs = append(inputs, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, path)
+			continue
+		}
+		var files []string
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		inputs = append(inputs, files...)
+	}
+	return inputs, nil
+}
+
+// backfill pushes every record of the inputs through the same throttling, routing and delivery as messages from
+// Kafka, using the given number of workers, and reports what happened.
+func (ing ingesterService) backfill(ctx context.Context, paths []string, workers int) (*backfillSummary, error) {
+	inputs, err := backfillInputs(paths)
+	if err != nil {
+		return nil, err
+	}
+	summary := &backfillSummary{Types: make(map[string]*backfillTypeCount), DryRun: ing.dryRun != nil}
+
+	msgs := make(chan queueConsumer.Message)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				ing.backfillMessage(ctx, msg, summary)
+			}
+		}()
+	}
+
+	for _, input := range inputs {
+		if err = ing.readBackfillInput(input, msgs, summary); err != nil {
+			break
+		}
+	}
+	close(msgs)
+	wg.Wait()
+	return summary, err
+}
+
+func (ing ingesterService) readBackfillInput(input string, msgs chan<- queueConsumer.Message, summary *backfillSummary) error {
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	log.Infof("Backfilling from %s", input)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBackfillRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record backfillRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		var msg queueConsumer.Message
+		if err == nil {
+			msg, err = record.message()
+		}
+		summary.mu.Lock()
+		summary.Records++
+		if err != nil {
+			summary.Invalid++
+		}
+		summary.mu.Unlock()
+		if err != nil {
+			log.Errorf("Skipping invalid record at %s:%d: %v", input, line, err)
+			continue
+		}
+		msgs <- msg
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Cannot read %s: %v", input, err)
+	}
+	return nil
+}
+
+func (ing ingesterService) backfillMessage(ctx context.Context, msg queueConsumer.Message, summary *backfillSummary) {
+	ingestionType, _, _ := extractMessageTypeAndId(msg.Headers)
+	ingestionType, _ = ing.deletes.detect(ingestionType, msg.Body)
+	handled := ing.handle(ctx, msg)
+
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	count := summary.typeCount(ingestionType)
+	switch {
+	case handled.err == nil:
+		summary.Delivered++
+		count.Delivered++
+	case handled.rejected:
+		summary.Rejected++
+		count.Rejected++
+	case handled.deadLettered:
+		summary.DeadLettered++
+		count.DeadLettered++
+	default:
+		// a dropped message was not written either, so it fails the backfill
+		summary.Failed++
+		count.Failed++
+	}
+	for _, outcome := range handled.outcomes {
+		if outcome.Err == nil && !outcome.Skipped && !outcome.Unchanged {
+			count.Destinations[outcome.Destination]++
+		}
+	}
+}
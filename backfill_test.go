@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBackfillFile(t *testing.T, dir string, name string, lines ...string) {
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func TestBackfillDeliversEveryRecordOfADirectory(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = string(body)
+		mu.Unlock()
+		if r.URL.Path == "/organisations/"+otherUUID {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "backfill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeBackfillFile(t, dir, "1.ndjson",
+		`{"headers": {"Message-Type": "organisations", "Message-Id": "`+uuid+`"}, "body": "{\"uuid\": \"`+uuid+`\"}"}`,
+		``,
+		`not json`)
+	writeBackfillFile(t, dir, "2.ndjson",
+		`{"headers": {"Message-Type": "organisations", "Message-Id": "`+otherUUID+`"}, "body": {"uuid": "`+otherUUID+`"}}`,
+		`{"headers": {"Message-Type": "organisations"}, "body": {"uuid": "`+conceptUUID(2)+`"}}`,
+		`{"headers": {"Message-Type": "organisations"}, "body": {}}`,
+		`{"body": {}}`)
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true}})
+	ing := ingesterService{routes: routes, client: &http.Client{}, deadLetters: &mockDeadLetterSink{}}
+
+	summary, err := ing.backfill(context.Background(), []string{dir}, 1)
+
+	require.NoError(t, err)
+	assert.Equal(t, 6, summary.Records)
+	assert.Equal(t, 2, summary.Invalid, "Malformed lines and records without a Message-Type should be invalid")
+	assert.Equal(t, 2, summary.Delivered, "A record without a Message-Id should be written under the uuid of its body")
+	assert.Equal(t, 1, summary.Rejected, "A record without any uuid should be rejected")
+	assert.Equal(t, 1, summary.DeadLettered)
+	assert.Equal(t, 0, summary.Failed)
+	assert.Equal(t, 2, summary.Types["organisations"].Destinations[neo4jDestination])
+	assert.Contains(t, bodies, "/organisations/"+conceptUUID(2))
+	assert.Equal(t, `{"uuid": "`+uuid+`"}`, bodies["/organisations/"+uuid], "A string body should be sent as it is")
+	assert.Equal(t, `{"uuid": "`+otherUUID+`"}`, bodies["/organisations/"+otherUUID], "An object body should be sent as the concept")
+}
+
+func TestBackfillCountsADroppedMessageAsFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "backfill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeBackfillFile(t, dir, "concepts.ndjson", `{"headers": {"Message-Type": "organisations", "Message-Id": "`+uuid+`"}, "body": "{}"}`)
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true}})
+	ing := ingesterService{routes: routes, client: &http.Client{}}
+	droppedMeter := metrics.GetOrRegisterMeter("organisations-DROPPED", metrics.DefaultRegistry)
+	droppedBefore := droppedMeter.Count()
+
+	summary, err := ing.backfill(context.Background(), []string{dir}, 1)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, int64(1), droppedMeter.Count()-droppedBefore, "The message should be dropped as it would be when consumed")
+}
+
+func TestBackfillDryRunWritesNothing(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "backfill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeBackfillFile(t, dir, "concepts.ndjson",
+		`{"headers": {"Message-Type": "organisations", "Message-Id": "`+uuid+`"}, "body": "{}"}`,
+		`{"headers": {"Message-Type": "organisations", "Message-Id": "`+otherUUID+`"}, "body": "{}"}`,
+		`{"headers": {"Message-Type": "brands", "Message-Id": "`+uuid+`"}, "body": "{}"}`)
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: elasticsearchDestination, URLTemplate: server.URL + "/bulk/{type}/{uuid}", Method: "PUT", Required: true},
+	})
+	ing := ingesterService{routes: routes, client: &http.Client{}, dryRun: newDryRunRecorder()}
+
+	summary, err := ing.backfill(context.Background(), []string{filepath.Join(dir, "concepts.ndjson")}, 2)
+
+	require.NoError(t, err)
+	assert.False(t, called, "Nothing should be written in a dry run")
+	assert.Equal(t, 2, summary.Delivered)
+	assert.Equal(t, 1, summary.Failed, "A message type without a route should fail")
+	assert.True(t, summary.DryRun)
+	assert.Equal(t, map[string]int{neo4jDestination: 2, elasticsearchDestination: 2}, summary.Types["organisations"].Destinations)
+}
+
+func TestBackfillInputsExpandDirectoriesInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "b"), 0755))
+	writeBackfillFile(t, dir, "c.ndjson")
+	writeBackfillFile(t, dir, "a.ndjson")
+	writeBackfillFile(t, filepath.Join(dir, "b"), "1.ndjson")
+
+	inputs, err := backfillInputs([]string{"-", dir})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-", filepath.Join(dir, "a.ndjson"), filepath.Join(dir, "b", "1.ndjson"), filepath.Join(dir, "c.ndjson")}, inputs)
+
+	_, err = backfillInputs([]string{filepath.Join(dir, "missing.ndjson")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// breakerOpenError is returned instead of calling a writer whose circuit breaker is open.
+// It is not transient, so the message is not retried but dead-lettered straight away.
+type breakerOpenError struct {
+	writer string
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker for writer %s is open", e.writer)
+}
+
+// circuitBreakers keeps a circuit breaker for each writer. A breaker opens after failureThreshold consecutive
+// transient failures and stays open for openTimeout. It then lets a single call through (half-open): if that call
+// succeeds the breaker closes, otherwise it opens again. While a breaker is open, calls to the writer either fail
+// fast or, if park is set, wait until the writer can be tried again.
+type circuitBreakers struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	park             bool
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// probing is true while the single call allowed by a half-open breaker is in flight
+	probing bool
+	gauge   metrics.Gauge
+	trips   metrics.Meter
+}
+
+func newCircuitBreakers(failureThreshold int, openTimeout time.Duration, park bool) *circuitBreakers {
+	return &circuitBreakers{failureThreshold: failureThreshold, openTimeout: openTimeout, park: park, breakers: make(map[string]*circuitBreaker)}
+}
+
+// allow returns nil if the writer may be called, and a breakerOpenError if it may not.
+// When parking, it waits until the writer may be called or ctx is done instead. A nil circuitBreakers allows every call.
+func (cb *circuitBreakers) allow(ctx context.Context, writer string) error {
+	if cb == nil {
+		return nil
+	}
+	for {
+		wait, err := cb.tryAllow(writer)
+		if err == nil || !cb.park {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tryAllow returns nil if the writer may be called now, otherwise an error and how long until it is worth asking again.
+func (cb *circuitBreakers) tryAllow(writer string) (time.Duration, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breaker(writer)
+	switch b.state {
+	case breakerClosed:
+		return 0, nil
+	case breakerOpen:
+		if remaining := cb.openTimeout - time.Since(b.openedAt); remaining > 0 {
+			return remaining, &breakerOpenError{writer: writer}
+		}
+		cb.setState(writer, b, breakerHalfOpen)
+	}
+	if b.probing {
+		return cb.openTimeout / 10, &breakerOpenError{writer: writer}
+	}
+	b.probing = true
+	return 0, nil
+}
+
+// record updates the writer's breaker with the result of a call. Only transient errors count as failures:
+// a writer that rejects a concept is still up.
+func (cb *circuitBreakers) record(writer string, err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b := cb.breaker(writer)
+	failed := err != nil && isTransient(err)
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= cb.failureThreshold {
+			cb.setState(writer, b, breakerOpen)
+		}
+	case breakerHalfOpen:
+		b.probing = false
+		if failed {
+			cb.setState(writer, b, breakerOpen)
+		} else {
+			cb.setState(writer, b, breakerClosed)
+		}
+	}
+}
+
+// breaker returns the writer's breaker, creating a closed one if needed. cb.mu must be held.
+func (cb *circuitBreakers) breaker(writer string) *circuitBreaker {
+	b, ok := cb.breakers[writer]
+	if !ok {
+		b = &circuitBreaker{
+			gauge: metrics.GetOrRegisterGauge("breaker-"+metricSafe(writer)+"-STATE", metrics.DefaultRegistry),
+			trips: metrics.GetOrRegisterMeter("breaker-"+metricSafe(writer)+"-OPEN", metrics.DefaultRegistry),
+		}
+		b.gauge.Update(int64(breakerClosed))
+		cb.breakers[writer] = b
+	}
+	return b
+}
+
+func (cb *circuitBreakers) setState(writer string, b *circuitBreaker, state breakerState) {
+	switch state {
+	case breakerOpen:
+		b.openedAt = time.Now()
+		b.trips.Mark(1)
+		log.Errorf("Circuit breaker for writer %s is open, not calling it for %v", writer, cb.openTimeout)
+	case breakerClosed:
+		log.Infof("Circuit breaker for writer %s is closed", writer)
+	}
+	b.state = state
+	b.failures = 0
+	b.gauge.Update(int64(state))
+}
+
+// states returns the state of every writer's breaker.
+func (cb *circuitBreakers) states() map[string]breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	states := make(map[string]breakerState, len(cb.breakers))
+	for writer, b := range cb.breakers {
+		states[writer] = b.state
+	}
+	return states
+}
+
+func (cb *circuitBreakers) healthCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Concepts for one or more writers are not being ingested",
+		Name:             "Writer circuit breakers",
+		PanicGuide:       "https://dewey.ft.com/concept-ingester.html",
+		Severity:         2,
+		TechnicalSummary: "One or more writers kept failing, so the ingester has stopped calling them for a while. Check the health of the writers; concepts for them are dead-lettered or held back until they recover.",
+		Checker:          cb.checkBreakers,
+	}
+}
+
+func (cb *circuitBreakers) checkBreakers() (string, error) {
+	states := cb.states()
+	writers := make([]string, 0, len(states))
+	for writer := range states {
+		writers = append(writers, writer)
+	}
+	sort.Strings(writers)
+
+	var all, open []string
+	for _, writer := range writers {
+		all = append(all, fmt.Sprintf("%s: %v", writer, states[writer]))
+		if states[writer] != breakerClosed {
+			open = append(open, writer)
+		}
+	}
+	output := strings.Join(all, ", ")
+	if len(open) > 0 {
+		return output, fmt.Errorf("Circuit breakers not closed for writers: %s", strings.Join(open, ", "))
+	}
+	return output, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const breakerWriter = "http://organisations-rw-neo4j:8080"
+
+func TestBreakerOpensAfterConsecutiveTransientFailures(t *testing.T) {
+	cb := newCircuitBreakers(3, time.Hour, false)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, cb.allow(context.Background(), breakerWriter))
+		cb.record(breakerWriter, &writerError{status: http.StatusServiceUnavailable})
+	}
+	cb.record(breakerWriter, nil)
+	for i := 0; i < 2; i++ {
+		cb.record(breakerWriter, &writerError{status: http.StatusServiceUnavailable})
+	}
+	assert.Equal(t, breakerClosed, cb.states()[breakerWriter], "A success should reset the count of consecutive failures")
+
+	cb.record(breakerWriter, &writerError{status: http.StatusBadRequest})
+	cb.record(breakerWriter, &writerError{})
+	cb.record(breakerWriter, &writerError{})
+	assert.Equal(t, breakerClosed, cb.states()[breakerWriter], "A rejected concept shows the writer is up, so it should reset the count too")
+
+	cb.record(breakerWriter, &writerError{})
+	assert.Equal(t, breakerOpen, cb.states()[breakerWriter])
+
+	err := cb.allow(context.Background(), breakerWriter)
+	assert.IsType(t, &breakerOpenError{}, err)
+	assert.False(t, isTransient(err), "Calls refused by an open breaker should not be retried")
+
+	output, err := cb.checkBreakers()
+	assert.Error(t, err)
+	assert.Equal(t, breakerWriter+": open", output)
+}
+
+func TestHalfOpenBreakerLetsOneCallThrough(t *testing.T) {
+	cb := newCircuitBreakers(1, 10*time.Millisecond, false)
+	cb.record(breakerWriter, &writerError{})
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, cb.allow(context.Background(), breakerWriter), "The first call after the timeout should be let through")
+	assert.Equal(t, breakerHalfOpen, cb.states()[breakerWriter])
+	assert.Error(t, cb.allow(context.Background(), breakerWriter), "Only one call should be let through while half-open")
+
+	cb.record(breakerWriter, nil)
+	assert.Equal(t, breakerClosed, cb.states()[breakerWriter])
+	assert.NoError(t, cb.allow(context.Background(), breakerWriter))
+}
+
+func TestFailedProbeReopensTheBreaker(t *testing.T) {
+	cb := newCircuitBreakers(1, 10*time.Millisecond, false)
+	cb.record(breakerWriter, &writerError{})
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, cb.allow(context.Background(), breakerWriter))
+	cb.record(breakerWriter, &writerError{})
+
+	assert.Equal(t, breakerOpen, cb.states()[breakerWriter])
+	assert.Error(t, cb.allow(context.Background(), breakerWriter))
+}
+
+func TestParkedCallWaitsForTheBreaker(t *testing.T) {
+	cb := newCircuitBreakers(1, 20*time.Millisecond, true)
+	cb.record(breakerWriter, &writerError{})
+
+	start := time.Now()
+	err := cb.allow(context.Background(), breakerWriter)
+
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 15*time.Millisecond, "The call should have waited for the breaker to half-open")
+}
+
+func TestOpenBreakerStopsCallsToTheWriter(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:   mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:   &http.Client{},
+		breakers: newCircuitBreakers(2, time.Hour, false),
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, 2, calls, "The writer should not be called once its breaker is open")
+	assert.Equal(t, breakerOpen, ing.breakers.states()[server.URL])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkWriter batches concepts for destinations with a bulk URL, and flushes each batch to the bulk endpoint
+// in elasticsearch bulk format once it holds maxItems concepts or its oldest concept has waited maxWait.
+// Every concept waits for its own result, so a partially failed bulk request only fails the items that were rejected.
+type bulkWriter struct {
+	maxItems int
+	maxWait  time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	batches map[string]*bulkBatch
+}
+
+// bulkBatch is the set of concepts of one type waiting to be sent to one bulk URL.
+type bulkBatch struct {
+	reqURL        string
+	ingestionType string
+	meterName     string
+	items         []bulkItem
+	timer         *time.Timer
+	// timeout bounds the bulk request. It is taken from the deadline of the write that started the batch.
+	timeout time.Duration
+}
+
+type bulkItem struct {
+	uuid          string
+	transactionID string
+	body          []byte
+	result        chan error
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	// Items holds one entry per concept in request order, keyed by the action, e.g. {"index": {"_id": "...", "status": 201}}
+	Items []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func newBulkWriter(maxItems int, maxWait time.Duration, client *http.Client) *bulkWriter {
+	return &bulkWriter{maxItems: maxItems, maxWait: maxWait, client: client, batches: make(map[string]*bulkBatch)}
+}
+
+// write adds the concept to the batch for its bulk URL and waits until that batch has been sent. When ctx is done
+// before then, the concept is taken out of its batch if the batch is still waiting, and otherwise gets the batch's
+// result, so that a retry never sends a concept that is already on its way.
+func (b *bulkWriter) write(ctx context.Context, d delivery, dest destination) error {
+	reqURL := dest.bulkURL(d.ingestionType)
+	var body bytes.Buffer
+	if err := json.Compact(&body, []byte(d.body)); err != nil {
+		return fmt.Errorf("Cannot add %s with uuid %s to bulk request: %v", d.ingestionType, d.uuid, err)
+	}
+	item := bulkItem{uuid: d.uuid, transactionID: d.transactionID, body: body.Bytes(), result: make(chan error, 1)}
+
+	b.mu.Lock()
+	batch, ok := b.batches[reqURL]
+	if !ok {
+		batch = &bulkBatch{reqURL: reqURL, ingestionType: d.ingestionType, meterName: dest.meterName(d.ingestionType, "BULK-FLUSH")}
+		if deadline, ok := ctx.Deadline(); ok {
+			batch.timeout = time.Until(deadline)
+		}
+		batch.timer = time.AfterFunc(b.maxWait, func() { b.flushBatch(batch) })
+		b.batches[reqURL] = batch
+	}
+	batch.items = append(batch.items, item)
+	full := len(batch.items) >= b.maxItems
+	if full {
+		delete(b.batches, reqURL)
+		batch.timer.Stop()
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.send(batch)
+	}
+	select {
+	case err := <-item.result:
+		return err
+	case <-ctx.Done():
+	}
+	if b.withdraw(batch, item) {
+		return &writerError{reqURL: reqURL, ingestionType: d.ingestionType, uuid: d.uuid, err: ctx.Err()}
+	}
+	return <-item.result
+}
+
+// withdraw takes the item out of its batch and reports whether it did, i.e. whether the batch was still waiting.
+func (b *bulkWriter) withdraw(batch *bulkBatch, item bulkItem) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batches[batch.reqURL] != batch {
+		return false
+	}
+	for i := range batch.items {
+		if batch.items[i].result == item.result {
+			batch.items = append(batch.items[:i], batch.items[i+1:]...)
+			break
+		}
+	}
+	if len(batch.items) == 0 {
+		batch.timer.Stop()
+		delete(b.batches, batch.reqURL)
+	}
+	return true
+}
+
+// flushBatch sends the batch if it is still waiting, i.e. it has not already been sent because it filled up.
+func (b *bulkWriter) flushBatch(batch *bulkBatch) {
+	b.mu.Lock()
+	if b.batches[batch.reqURL] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, batch.reqURL)
+	b.mu.Unlock()
+	b.send(batch)
+}
+
+// flush sends every batch that is still waiting.
+func (b *bulkWriter) flush() {
+	b.mu.Lock()
+	batches := make([]*bulkBatch, 0, len(b.batches))
+	for reqURL, batch := range b.batches {
+		batch.timer.Stop()
+		batches = append(batches, batch)
+		delete(b.batches, reqURL)
+	}
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch *bulkBatch) {
+			defer wg.Done()
+			b.send(batch)
+		}(batch)
+	}
+	wg.Wait()
+}
+
+func (b *bulkWriter) send(batch *bulkBatch) {
+	errs := b.post(batch)
+	for i, item := range batch.items {
+		item.result <- errs[i]
+	}
+}
+
+// post sends the batch and returns the error, if any, for each of its items.
+func (b *bulkWriter) post(batch *bulkBatch) []error {
+	errs := make([]error, len(batch.items))
+	failAll := func(err *writerError) []error {
+		for i, item := range batch.items {
+			itemErr := *err
+			itemErr.uuid = item.uuid
+			errs[i] = &itemErr
+		}
+		return errs
+	}
+
+	var body bytes.Buffer
+	transactionIDs := make([]string, 0, len(batch.items))
+	for _, item := range batch.items {
+		fmt.Fprintf(&body, `{"index":{"_id":%q}}`+"\n", item.uuid)
+		body.Write(item.body)
+		body.WriteString("\n")
+		transactionIDs = append(transactionIDs, item.transactionID)
+	}
+
+	request, err := http.NewRequest("POST", batch.reqURL, &body)
+	if err != nil {
+		return failAll(&writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, err: err})
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	ctx, cancel := withTimeout(context.Background(), batch.timeout)
+	defer cancel()
+	request = request.WithContext(ctx)
+
+	metrics.GetOrRegisterMeter(batch.meterName, metrics.DefaultRegistry).Mark(1)
+	log.Infof("Sending bulk of %d %s to %s, transactions: %s", len(batch.items), batch.ingestionType, batch.reqURL, strings.Join(transactionIDs, ","))
+
+	resp, err := b.client.Do(request)
+	if err != nil {
+		return failAll(&writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, err: err})
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return failAll(&writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, status: resp.StatusCode, err: err})
+	}
+	if resp.StatusCode != http.StatusOK {
+		return failAll(&writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, status: resp.StatusCode, body: string(respBody)})
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(respBody, &result); err != nil || len(result.Items) != len(batch.items) {
+		log.Errorf("Cannot match bulk response from %s to its %d items: %v", batch.reqURL, len(batch.items), err)
+		return failAll(&writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, status: http.StatusBadGateway, body: string(respBody)})
+	}
+	for i, item := range result.Items {
+		for _, itemResult := range item {
+			if itemResult.Status < 200 || itemResult.Status > 299 {
+				errs[i] = &writerError{reqURL: batch.reqURL, ingestionType: batch.ingestionType, uuid: batch.items[i].uuid, status: itemResult.Status, body: string(itemResult.Error)}
+			}
+		}
+	}
+	return errs
+}
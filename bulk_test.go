@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bulkServer records the uuids of each bulk request it receives and rejects the uuids in rejected.
+type bulkServer struct {
+	mu       sync.Mutex
+	requests [][]string
+	paths    []string
+	rejected map[string]bool
+}
+
+func (s *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var uuids []string
+	var items []map[string]bulkItemResult
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action map[string]struct {
+			ID string `json:"_id"`
+		}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		id := action["index"].ID
+		uuids = append(uuids, id)
+		if s.rejected[id] {
+			items = append(items, map[string]bulkItemResult{"index": {ID: id, Status: http.StatusBadRequest, Error: json.RawMessage(`{"type":"mapper_parsing_exception"}`)}})
+		} else {
+			items = append(items, map[string]bulkItemResult{"index": {ID: id, Status: http.StatusCreated}})
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, uuids)
+	s.paths = append(s.paths, r.URL.Path)
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(bulkResponse{Errors: len(s.rejected) > 0, Items: items})
+}
+
+func TestBulkWriterFlushesWhenTheBatchIsFull(t *testing.T) {
+	bs := &bulkServer{}
+	server := httptest.NewServer(bs)
+	defer server.Close()
+
+	writer := newBulkWriter(3, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	errs := writeConcurrently(writer, dest, 3)
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	require.Len(t, bs.requests, 1, "A full batch should be sent without waiting")
+	assert.Len(t, bs.requests[0], 3)
+	assert.Equal(t, "/bulk/organisations", bs.paths[0])
+}
+
+func TestBulkWriterFlushesAfterTheInterval(t *testing.T) {
+	bs := &bulkServer{}
+	server := httptest.NewServer(bs)
+	defer server.Close()
+
+	writer := newBulkWriter(100, 10*time.Millisecond, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	err := writer.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{}`}, dest)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{uuid}}, bs.requests)
+}
+
+func TestBulkWriterWithdrawsAConceptGivenUpOnBeforeItsBatchIsSent(t *testing.T) {
+	bs := &bulkServer{}
+	server := httptest.NewServer(bs)
+	defer server.Close()
+
+	writer := newBulkWriter(100, 50*time.Millisecond, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.Error(t, writer.write(ctx, delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{}`}, dest))
+	assert.NoError(t, writer.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: otherUUID, body: `{}`}, dest))
+
+	assert.Equal(t, [][]string{{otherUUID}}, bs.requests, "A concept given up on should not be sent with its batch")
+}
+
+func TestBulkWriterWaitsForABatchAlreadyBeingSent(t *testing.T) {
+	bs := &bulkServer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		bs.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	writer := newBulkWriter(1, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	// cancelled rather than given a deadline, which would also bound the bulk request
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	assert.NoError(t, writer.write(ctx, delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{}`}, dest),
+		"A concept whose batch is on its way should get the batch's result, so it is not sent again")
+	assert.Equal(t, [][]string{{uuid}}, bs.requests)
+}
+
+func TestBulkWriterFailsOnlyTheRejectedItems(t *testing.T) {
+	bs := &bulkServer{rejected: map[string]bool{conceptUUID(1): true}}
+	server := httptest.NewServer(bs)
+	defer server.Close()
+
+	writer := newBulkWriter(3, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	errs := writeConcurrently(writer, dest, 3)
+
+	assert.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	assert.NoError(t, errs[2])
+	wErr, ok := errs[1].(*writerError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, wErr.status)
+	assert.Equal(t, conceptUUID(1), wErr.uuid)
+	assert.Contains(t, wErr.body, "mapper_parsing_exception")
+	assert.False(t, isTransient(errs[1]), "A rejected item should not be retried")
+}
+
+func TestBulkWriterFailsEveryItemWhenTheRequestFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	writer := newBulkWriter(2, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	errs := writeConcurrently(writer, dest, 2)
+
+	for _, err := range errs {
+		assert.Error(t, err)
+		assert.True(t, isTransient(err), "A failed bulk request should be retried")
+	}
+}
+
+func TestBulkWriterRejectsInvalidJSON(t *testing.T) {
+	writer := newBulkWriter(2, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: "http://localhost/bulk/{type}"}
+
+	err := writer.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{transformed-org-json`}, dest)
+
+	assert.Error(t, err)
+}
+
+func TestBulkWriterFlushSendsWaitingBatches(t *testing.T) {
+	bs := &bulkServer{}
+	server := httptest.NewServer(bs)
+	defer server.Close()
+
+	writer := newBulkWriter(100, time.Hour, &http.Client{})
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: server.URL + "/bulk/{type}"}
+
+	result := make(chan error)
+	go func() {
+		result <- writer.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{}`}, dest)
+	}()
+	waitForBatchedItems(writer, 1)
+	writer.flush()
+
+	assert.NoError(t, <-result)
+	assert.Len(t, bs.requests, 1)
+}
+
+func TestElasticsearchWritesAreBatched(t *testing.T) {
+	bs := &bulkServer{}
+	esServer := httptest.NewServer(bs)
+	defer esServer.Close()
+	neo4jServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer neo4jServer.Close()
+
+	ing := ingesterService{
+		routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": neo4jServer.URL}, esServer.URL+"/bulk"),
+		client: &http.Client{},
+		bulk:   newBulkWriter(2, time.Hour, &http.Client{}),
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := createMessage(conceptUUID(i), validMessageTypeOrganisations)
+			msg.Body = `{"uuid": "` + conceptUUID(i) + `"}`
+			_, errs[i] = ing.processMessage(context.Background(), msg)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	require.Len(t, bs.requests, 1)
+	assert.Equal(t, "/bulk/organisations", bs.paths[0])
+	assert.Len(t, bs.requests[0], 2)
+}
+
+// writeConcurrently writes n organisations and returns their errors in uuid order.
+// Each write starts once the previous one has joined the batch, so the batch keeps that order.
+func writeConcurrently(writer *bulkWriter, dest destination, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = writer.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: conceptUUID(i), body: `{"uuid": "` + conceptUUID(i) + `"}`}, dest)
+		}(i)
+		waitForBatchedItems(writer, i+1)
+	}
+	wg.Wait()
+	return errs
+}
+
+// waitForBatchedItems waits until n items are waiting in a batch, or the batch has been sent because n filled it up.
+func waitForBatchedItems(writer *bulkWriter, n int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		writer.mu.Lock()
+		waiting := 0
+		for _, batch := range writer.batches {
+			waiting += len(batch.items)
+		}
+		writer.mu.Unlock()
+		if waiting >= n || waiting == 0 && n%writer.maxItems == 0 {
+			return
+		}
+	}
+}
+
+func conceptUUID(i int) string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// coalescer holds back the messages of some types for a window, so that when several versions of a concept arrive
+// within the window only the latest is delivered. The window starts with the first message for the concept, so a
+// concept that keeps changing is still delivered once per window.
+type coalescer struct {
+	windows map[string]time.Duration
+	process func(ctx context.Context, msg queueConsumer.Message) error
+	// ctx is cancelled when a flush runs out of time, so that the updates still being sent give up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	pending  map[string]*pendingUpdate
+	flushing bool
+}
+
+// pendingUpdate is the latest message for a concept waiting for its window to close. While a message for the
+// concept is being processed the next one waits for it, so that the updates of a concept are still processed in order.
+type pendingUpdate struct {
+	ingestionType string
+	msg           *queueConsumer.Message
+	sending       bool
+	timer         *time.Timer
+}
+
+func newCoalescer(windows map[string]time.Duration, process func(ctx context.Context, msg queueConsumer.Message) error) *coalescer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &coalescer{windows: windows, process: process, ctx: ctx, cancel: cancel, pending: make(map[string]*pendingUpdate)}
+}
+
+// parseCoalesceWindows reads a comma separated list of type=milliseconds windows, e.g. organisations=2000,people=500.
+func parseCoalesceWindows(windows string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration)
+	for _, entry := range strings.Split(windows, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid coalesce window %q, expected type=milliseconds", entry)
+		}
+		ms, err := strconv.Atoi(entry[i+1:])
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("Invalid coalesce window %q, expected a positive number of milliseconds", entry)
+		}
+		parsed[entry[:i]] = time.Duration(ms) * time.Millisecond
+	}
+	return parsed, nil
+}
+
+// add holds back the message if its type has a window, replacing any earlier message for the concept still waiting,
+// and reports whether it did. A nil coalescer holds back nothing.
+func (c *coalescer) add(ingestionType string, uuid string, msg queueConsumer.Message) bool {
+	if c == nil {
+		return false
+	}
+	window, ok := c.windows[ingestionType]
+	if !ok {
+		return false
+	}
+	key := ingestionType + "/" + uuid
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update, ok := c.pending[key]
+	if !ok {
+		update = &pendingUpdate{ingestionType: ingestionType, msg: &msg}
+		c.pending[key] = update
+		c.schedule(key, update, window)
+		return true
+	}
+	if update.msg != nil {
+		coalescedMeter := metrics.GetOrRegisterMeter(ingestionType+"-COALESCED", metrics.DefaultRegistry)
+		coalescedMeter.Mark(1)
+		log.Infof("Coalesced %s with uuid: %s into a later update", ingestionType, uuid)
+	}
+	update.msg = &msg
+	return true
+}
+
+// schedule sends the update once the window closes, or straight away when flushing. c.mu must be held.
+func (c *coalescer) schedule(key string, update *pendingUpdate, window time.Duration) {
+	if c.flushing {
+		go c.send(key)
+		return
+	}
+	update.timer = time.AfterFunc(window, func() { c.send(key) })
+}
+
+func (c *coalescer) send(key string) {
+	c.mu.Lock()
+	update := c.pending[key]
+	msg := update.msg
+	update.msg = nil
+	update.sending = true
+	c.mu.Unlock()
+
+	if err := c.process(c.ctx, *msg); err != nil {
+		log.Errorf("Coalesced update to %s was neither delivered nor set aside, it may need replaying: %v", key, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update.sending = false
+	if update.msg == nil {
+		delete(c.pending, key)
+		return
+	}
+	c.schedule(key, update, c.windows[update.ingestionType])
+}
+
+// flush sends every update still waiting without waiting for its window, and waits until they have been processed or
+// the deadline passes, when the updates still being sent are cancelled. It returns the number of concepts with updates
+// not yet processed. A nil coalescer has nothing to flush.
+func (c *coalescer) flush(deadline time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	c.flushing = true
+	for key, update := range c.pending {
+		// updates that are being sent, or whose timer has already fired, are sent anyway
+		if !update.sending && update.timer.Stop() {
+			go c.send(key)
+		}
+	}
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		pending := len(c.pending)
+		c.mu.Unlock()
+		if pending == 0 {
+			return 0
+		}
+		if !time.Now().Before(deadline) {
+			c.cancel()
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type writeRecorder struct {
+	mu     sync.Mutex
+	bodies map[string][]string
+}
+
+func (r *writeRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], string(body))
+}
+
+func (r *writeRecorder) written(path string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies[path]...)
+}
+
+func newCoalescingIngester(t *testing.T, serverURL string, window time.Duration) *ingesterService {
+	ing := &ingesterService{
+		routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": serverURL}, ""),
+		client: &http.Client{},
+	}
+	ing.coalesce = newCoalescer(map[string]time.Duration{validMessageTypeOrganisations: window}, func(ctx context.Context, msg queueConsumer.Message) error {
+		err := ing.handleImmediately(ctx, msg)
+		assert.NoError(t, err)
+		return err
+	})
+	return ing
+}
+
+func versionOf(id string, version string) queueConsumer.Message {
+	msg := createMessage(id, validMessageTypeOrganisations)
+	msg.Body = `{"uuid": "` + id + `", "version": "` + version + `"}`
+	return msg
+}
+
+func TestRapidUpdatesAreCoalesced(t *testing.T) {
+	writes := &writeRecorder{bodies: make(map[string][]string)}
+	server := httptest.NewServer(writes)
+	defer server.Close()
+	ing := newCoalescingIngester(t, server.URL, 50*time.Millisecond)
+	coalescedCount := getCoalescedCount()
+
+	for _, version := range []string{"1", "2", "3"} {
+		require.NoError(t, ing.handleMessage(context.Background(), versionOf(uuid, version)))
+	}
+	require.NoError(t, ing.handleMessage(context.Background(), versionOf(otherUUID, "1")))
+	assert.Empty(t, writes.written("/organisations/"+uuid), "Nothing should be written before the window closes")
+
+	assert.Equal(t, 0, ing.coalesce.flush(time.Now().Add(time.Second)))
+	assert.Equal(t, []string{versionOf(uuid, "3").Body}, writes.written("/organisations/"+uuid), "Only the latest update should be written")
+	assert.Equal(t, []string{versionOf(otherUUID, "1").Body}, writes.written("/organisations/"+otherUUID))
+	assert.Equal(t, int64(2), getCoalescedCount()-coalescedCount)
+}
+
+func TestCoalescedUpdatesAreWrittenWhenTheWindowCloses(t *testing.T) {
+	writes := &writeRecorder{bodies: make(map[string][]string)}
+	server := httptest.NewServer(writes)
+	defer server.Close()
+	ing := newCoalescingIngester(t, server.URL, 20*time.Millisecond)
+
+	require.NoError(t, ing.handleMessage(context.Background(), versionOf(uuid, "1")))
+	waitFor(t, func() bool { return len(writes.written("/organisations/"+uuid)) == 1 }, "The update should be written when the window closes")
+	require.NoError(t, ing.handleMessage(context.Background(), versionOf(uuid, "2")))
+	waitFor(t, func() bool { return len(writes.written("/organisations/"+uuid)) == 2 }, "An update after the window closed should be written in the next window")
+}
+
+func TestUpdatesStillBeingSentAreCancelledWhenTheFlushRunsOutOfTime(t *testing.T) {
+	cancelled := make(chan error, 1)
+	c := newCoalescer(map[string]time.Duration{validMessageTypeOrganisations: time.Hour}, func(ctx context.Context, msg queueConsumer.Message) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+	require.True(t, c.add(validMessageTypeOrganisations, uuid, createMessage(uuid, validMessageTypeOrganisations)))
+
+	assert.Equal(t, 1, c.flush(time.Now().Add(20*time.Millisecond)))
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("The update being sent should have been cancelled")
+	}
+}
+
+func TestTypesWithoutAWindowAreNotCoalesced(t *testing.T) {
+	c := newCoalescer(map[string]time.Duration{"people": time.Hour}, func(ctx context.Context, msg queueConsumer.Message) error { return nil })
+	assert.False(t, c.add(validMessageTypeOrganisations, uuid, createMessage(uuid, validMessageTypeOrganisations)))
+	var none *coalescer
+	assert.False(t, none.add(validMessageTypeOrganisations, uuid, createMessage(uuid, validMessageTypeOrganisations)))
+}
+
+func TestParseCoalesceWindows(t *testing.T) {
+	windows, err := parseCoalesceWindows("organisations=2000, people=500")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"organisations": 2 * time.Second, "people": 500 * time.Millisecond}, windows)
+
+	for _, invalid := range []string{"organisations", "organisations=soon", "organisations=0"} {
+		_, err = parseCoalesceWindows(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func getCoalescedCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-COALESCED", metrics.DefaultRegistry).Count()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// committingConsumer reads from the kafka-rest-proxy with auto commit disabled and commits a batch of messages only
+// once every message in it has been handled, i.e. delivered to its required destinations or dead-lettered.
+// The proxy commits everything a consumer instance has fetched, so when any message of a batch is not handled the
+// instance is dropped without committing and a new one is created, which gets the batch again from the last commit.
+type committingConsumer struct {
+	addr    string
+	group   string
+	topic   string
+	queue   string
+	offset  string
+	client  *http.Client
+	handler func(msg queueConsumer.Message) error
+	// dispatch starts handling a message and returns a channel for its result. By default each message of a batch
+	// is handled in its own goroutine.
+	dispatch func(msg queueConsumer.Message) <-chan error
+	backoff  time.Duration
+
+	instanceURL string
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+type proxyInstance struct {
+	InstanceID string `json:"instance_id"`
+}
+
+type proxyMessage struct {
+	Value     []byte `json:"value"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+func newCommittingConsumer(config queueConsumer.QueueConfig, handler func(msg queueConsumer.Message) error, backoff time.Duration, client *http.Client) *committingConsumer {
+	c := &committingConsumer{
+		addr:    config.Addrs[0],
+		group:   config.Group,
+		topic:   config.Topic,
+		queue:   config.Queue,
+		offset:  config.Offset,
+		client:  client,
+		handler: handler,
+		backoff: backoff,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	c.dispatch = c.handleConcurrently
+	return c
+}
+
+func (c *committingConsumer) handleConcurrently(msg queueConsumer.Message) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- c.handler(msg)
+	}()
+	return result
+}
+
+// Start consumes until Stop is called. A batch that is being handled when Stop is called is finished first.
+func (c *committingConsumer) Start() {
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.stop:
+			c.destroyInstance()
+			return
+		default:
+		}
+		if !c.consumeBatch() {
+			select {
+			case <-c.stop:
+			case <-time.After(c.backoff):
+			}
+		}
+	}
+}
+
+func (c *committingConsumer) Stop() {
+	close(c.stop)
+	<-c.stopped
+}
+
+func (c *committingConsumer) ConnectivityCheck() (string, error) {
+	resp, err := c.do("GET", c.addr+"/topics", nil)
+	if err != nil {
+		return "Error connecting to the queue", err
+	}
+	defer readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "Error connecting to the queue", fmt.Errorf("Unexpected response status %d from %s", resp.StatusCode, c.addr+"/topics")
+	}
+	return "", nil
+}
+
+// consumeBatch fetches and handles one batch of messages. It returns false if there was nothing to do or it failed,
+// so that the caller backs off before the next batch.
+func (c *committingConsumer) consumeBatch() bool {
+	if c.instanceURL == "" {
+		if err := c.createInstance(); err != nil {
+			log.Errorf("Cannot create consumer instance: %v", err)
+			return false
+		}
+	}
+	msgs, err := c.fetch()
+	if err != nil {
+		log.Errorf("Cannot fetch messages: %v", err)
+		c.destroyInstance()
+		return false
+	}
+	if len(msgs) == 0 {
+		return false
+	}
+
+	results := make([]<-chan error, len(msgs))
+	for i, msg := range msgs {
+		results[i] = c.dispatch(msg)
+	}
+	errs := make([]error, len(msgs))
+	for i, result := range results {
+		errs[i] = <-result
+	}
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		metrics.GetOrRegisterMeter("consumer-UNCOMMITTED", metrics.DefaultRegistry).Mark(1)
+		log.Warnf("Not committing a batch of %d messages, %d could not be delivered or dead-lettered; the batch will be consumed again", len(msgs), failed)
+		c.destroyInstance()
+		return false
+	}
+	if err := c.commit(); err != nil {
+		log.Errorf("Cannot commit a batch of %d messages, the batch will be consumed again: %v", len(msgs), err)
+		c.destroyInstance()
+		return false
+	}
+	metrics.GetOrRegisterMeter("consumer-COMMITTED", metrics.DefaultRegistry).Mark(1)
+	return true
+}
+
+func (c *committingConsumer) createInstance() error {
+	config := map[string]string{"auto.commit.enable": "false"}
+	if c.offset != "" {
+		config["auto.offset.reset"] = c.offset
+	}
+	body, _ := json.Marshal(config)
+	resp, err := c.do("POST", c.addr+"/consumers/"+c.group, body)
+	if err != nil {
+		return err
+	}
+	defer readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status %d creating consumer instance in group %s", resp.StatusCode, c.group)
+	}
+	var instance proxyInstance
+	if err := json.NewDecoder(resp.Body).Decode(&instance); err != nil {
+		return fmt.Errorf("Cannot read consumer instance: %v", err)
+	}
+	c.instanceURL = c.addr + "/consumers/" + c.group + "/instances/" + instance.InstanceID
+	log.Infof("Created consumer instance %s", c.instanceURL)
+	return nil
+}
+
+func (c *committingConsumer) fetch() ([]queueConsumer.Message, error) {
+	resp, err := c.do("GET", c.instanceURL+"/topics/"+c.topic, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response status %d fetching from topic %s", resp.StatusCode, c.topic)
+	}
+	var records []proxyMessage
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, fmt.Errorf("Cannot read messages: %v", err)
+	}
+	msgs := make([]queueConsumer.Message, 0, len(records))
+	for _, record := range records {
+		msg, err := decodeFTMessage(record.Value)
+		if err != nil {
+			log.Errorf("Skipping message at partition %d offset %d: %v", record.Partition, record.Offset, err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (c *committingConsumer) commit() error {
+	resp, err := c.do("POST", c.instanceURL+"/offsets", nil)
+	if err != nil {
+		return err
+	}
+	defer readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response status %d committing offsets", resp.StatusCode)
+	}
+	return nil
+}
+
+// destroyInstance drops the consumer instance, losing anything it fetched but did not commit.
+func (c *committingConsumer) destroyInstance() {
+	if c.instanceURL == "" {
+		return
+	}
+	resp, err := c.do("DELETE", c.instanceURL, nil)
+	if err != nil {
+		log.Warnf("Cannot delete consumer instance %s: %v", c.instanceURL, err)
+	} else {
+		readBody(resp)
+	}
+	c.instanceURL = ""
+}
+
+func (c *committingConsumer) do(method string, reqURL string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.v1+json")
+	request.Header.Set("Accept", "application/json")
+	if c.queue != "" {
+		request.Host = c.queue
+	}
+	return c.client.Do(request)
+}
+
+// decodeFTMessage parses a message in the FTMSG/1.0 format used on the UPP Kafka topics.
+func decodeFTMessage(raw []byte) (queueConsumer.Message, error) {
+	msg := string(raw)
+	if !strings.HasPrefix(msg, "FTMSG/1.0\r\n") {
+		return queueConsumer.Message{}, fmt.Errorf("Not an FTMSG/1.0 message")
+	}
+	head, body := strings.TrimPrefix(msg, "FTMSG/1.0"), ""
+	if i := strings.Index(head, "\r\n\r\n"); i >= 0 {
+		head, body = head[:i], head[i+4:]
+	}
+	headers := make(map[string]string)
+	for _, line := range strings.Split(head, "\r\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			headers[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return queueConsumer.Message{Headers: headers, Body: body}, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProxy is a kafka-rest-proxy with one partition and one consumer group. Like the real proxy, committing
+// commits everything the instance has fetched, and a new instance starts from the last commit.
+type fakeProxy struct {
+	mu        sync.Mutex
+	messages  [][]byte
+	batchSize int
+	committed int
+	instances map[string]int
+	created   int
+	// config is what the last instance was created with
+	config map[string]string
+}
+
+func newFakeProxy(batchSize int, uuids ...string) *fakeProxy {
+	p := &fakeProxy{batchSize: batchSize, instances: make(map[string]int)}
+	for _, id := range uuids {
+		msg := createMessage(id, validMessageTypeOrganisations)
+		p.messages = append(p.messages, encodeFTMessage(msg.Headers, msg.Body))
+	}
+	return p
+}
+
+func (p *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/topics":
+		w.Write([]byte(`["Concept"]`))
+	case r.Method == "POST" && len(path) == 2:
+		p.config = nil
+		json.NewDecoder(r.Body).Decode(&p.config)
+		p.created++
+		id := fmt.Sprintf("instance-%d", p.created)
+		p.instances[id] = p.committed
+		json.NewEncoder(w).Encode(proxyInstance{InstanceID: id})
+	case len(path) >= 4:
+		position, ok := p.instances[path[3]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == "GET" && len(path) == 6:
+			end := position + p.batchSize
+			if end > len(p.messages) {
+				end = len(p.messages)
+			}
+			records := make([]proxyMessage, 0)
+			for offset := position; offset < end; offset++ {
+				records = append(records, proxyMessage{Value: p.messages[offset], Offset: int64(offset)})
+			}
+			p.instances[path[3]] = end
+			json.NewEncoder(w).Encode(records)
+		case r.Method == "POST" && len(path) == 5:
+			p.committed = position
+		case r.Method == "DELETE":
+			delete(p.instances, path[3])
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (p *fakeProxy) instanceConfig() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+func (p *fakeProxy) committedOffset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.committed
+}
+
+// handledMessages records how many times each message was handled.
+type handledMessages struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (h *handledMessages) record(msg queueConsumer.Message) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[string]int)
+	}
+	h.counts[msg.Headers["Message-Id"]]++
+	return h.counts[msg.Headers["Message-Id"]]
+}
+
+func (h *handledMessages) count(id string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[id]
+}
+
+func newTestCommittingConsumer(proxyURL string, handler func(msg queueConsumer.Message) error) *committingConsumer {
+	config := queueConsumer.QueueConfig{Addrs: []string{proxyURL}, Group: "TestConcepts", Topic: "Concept", Offset: "smallest"}
+	return newCommittingConsumer(config, handler, time.Millisecond, &http.Client{})
+}
+
+func TestInstanceIsCreatedWithAutoCommitDisabled(t *testing.T) {
+	proxy := newFakeProxy(1)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	c := newTestCommittingConsumer(server.URL, func(msg queueConsumer.Message) error { return nil })
+	go c.Start()
+	waitFor(t, func() bool { return proxy.instanceConfig() != nil }, "An instance should have been created")
+	c.Stop()
+
+	assert.Equal(t, map[string]string{"auto.commit.enable": "false", "auto.offset.reset": "smallest"}, proxy.instanceConfig())
+}
+
+func TestInstanceIsCreatedWithoutAnOffsetResetWhenNoOffsetIsConfigured(t *testing.T) {
+	proxy := newFakeProxy(1)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	config := queueConsumer.QueueConfig{Addrs: []string{server.URL}, Group: "TestConcepts", Topic: "Concept"}
+	c := newCommittingConsumer(config, func(msg queueConsumer.Message) error { return nil }, time.Millisecond, &http.Client{})
+	go c.Start()
+	waitFor(t, func() bool { return proxy.instanceConfig() != nil }, "An instance should have been created")
+	c.Stop()
+
+	assert.Equal(t, map[string]string{"auto.commit.enable": "false"}, proxy.instanceConfig(), "The proxy's own default offset reset should apply")
+}
+
+func TestBatchIsCommittedOnceEveryMessageIsHandled(t *testing.T) {
+	proxy := newFakeProxy(3, conceptUUID(0), conceptUUID(1), conceptUUID(2))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	handled := &handledMessages{}
+	c := newTestCommittingConsumer(server.URL, func(msg queueConsumer.Message) error {
+		handled.record(msg)
+		return nil
+	})
+	go c.Start()
+	waitFor(t, func() bool { return proxy.committedOffset() == 3 }, "The batch should have been committed")
+	c.Stop()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 1, handled.count(conceptUUID(i)))
+	}
+	proxy.mu.Lock()
+	assert.Empty(t, proxy.instances, "The instance should be deleted when the consumer stops")
+	proxy.mu.Unlock()
+}
+
+func TestBatchWithAFailedMessageIsConsumedAgain(t *testing.T) {
+	proxy := newFakeProxy(3, conceptUUID(0), conceptUUID(1), conceptUUID(2))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	handled := &handledMessages{}
+	c := newTestCommittingConsumer(server.URL, func(msg queueConsumer.Message) error {
+		if handled.record(msg) == 1 && msg.Headers["Message-Id"] == conceptUUID(1) {
+			return errors.New("writer unavailable")
+		}
+		return nil
+	})
+	go c.Start()
+	waitFor(t, func() bool { return proxy.committedOffset() == 3 }, "The batch should be committed once every message has been handled")
+	c.Stop()
+
+	assert.Equal(t, 2, handled.count(conceptUUID(1)), "The failed message should have been redelivered")
+	assert.Equal(t, 2, handled.count(conceptUUID(0)), "The whole uncommitted batch is redelivered")
+}
+
+func TestCrashMidBatchRedeliversTheUncommittedMessages(t *testing.T) {
+	proxy := newFakeProxy(2, conceptUUID(0), conceptUUID(1), conceptUUID(2), conceptUUID(3))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	// the first consumer handles the first batch, then dies while handling the second
+	crashed := make(chan struct{})
+	release := make(chan struct{})
+	first := &handledMessages{}
+	crashing := newTestCommittingConsumer(server.URL, func(msg queueConsumer.Message) error {
+		first.record(msg)
+		if msg.Headers["Message-Id"] == conceptUUID(3) {
+			close(crashed)
+			<-release
+			return errors.New("crashed")
+		}
+		return nil
+	})
+	go crashing.Start()
+	<-crashed
+	assert.Equal(t, 2, proxy.committedOffset(), "Only the first batch should have been committed")
+
+	second := &handledMessages{}
+	restarted := newTestCommittingConsumer(server.URL, func(msg queueConsumer.Message) error {
+		second.record(msg)
+		return nil
+	})
+	go restarted.Start()
+	waitFor(t, func() bool { return proxy.committedOffset() == 4 }, "The restarted consumer should commit the rest of the topic")
+	restarted.Stop()
+	close(release)
+	crashing.Stop()
+
+	assert.Equal(t, 0, second.count(conceptUUID(0)), "Committed messages should not be redelivered")
+	assert.Equal(t, 0, second.count(conceptUUID(1)), "Committed messages should not be redelivered")
+	assert.Equal(t, 1, second.count(conceptUUID(2)), "Messages of the interrupted batch should be redelivered, even those that were handled")
+	assert.Equal(t, 1, second.count(conceptUUID(3)), "Messages of the interrupted batch should be redelivered")
+	assert.Equal(t, 4, proxy.committedOffset(), "The crashed consumer should not commit after the fact")
+}
+
+func TestDeadLetteredMessageCountsAsHandled(t *testing.T) {
+	ing := ingesterService{routes: mustRoutingTable(correctWriterMappings, ""), client: &http.Client{}, deadLetters: &mockDeadLetterSink{}}
+	assert.NoError(t, ing.handleMessage(context.Background(), createMessage(uuid, invalidMessageType)))
+
+	ing.deadLetters = nil
+	assert.Error(t, ing.handleMessage(context.Background(), createMessage(uuid, invalidMessageType)), "A message that was neither delivered nor dead-lettered should not be committed")
+}
+
+func TestPoisonMessageCountsAsHandledWithoutADeadLetterSink(t *testing.T) {
+	droppedCount := getDroppedCount()
+	for _, test := range []struct {
+		status  int
+		handled bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusServiceUnavailable, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		}))
+		ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""), client: &http.Client{}}
+		err := ing.handleMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+		server.Close()
+		if test.handled {
+			assert.NoError(t, err, "A message its writer rejects should not hold up its partition")
+		} else {
+			assert.Error(t, err, "A message that may yet be written should not be committed")
+		}
+	}
+	assert.Equal(t, int64(1), getDroppedCount()-droppedCount)
+}
+
+func getDroppedCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-DROPPED", metrics.DefaultRegistry).Count()
+}
+
+func TestFTMessageRoundTrip(t *testing.T) {
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Body = "{\r\n  \"uuid\": \"" + uuid + "\"\r\n}"
+
+	decoded, err := decodeFTMessage(encodeFTMessage(msg.Headers, msg.Body))
+
+	require.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+
+	_, err = decodeFTMessage([]byte(`{"uuid": "` + uuid + `"}`))
+	assert.Error(t, err)
+}
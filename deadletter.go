@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// deadLetter is a message that could not be delivered, together with the reason it was given up on.
+type deadLetter struct {
+	ID         string            `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	WriterURL  string            `json:"writerUrl,omitempty"`
+	StatusCode int               `json:"statusCode,omitempty"`
+	ErrorBody  string            `json:"errorBody,omitempty"`
+	Error      string            `json:"error"`
+	// ValidationErrors lists why a rejected concept does not match the schema for its type
+	ValidationErrors []string `json:"validationErrors,omitempty"`
+}
+
+var deadLetterHeaders = []string{"Message-Type", "Message-Id", "X-Request-Id"}
+
+// newDeadLetter keeps the deadLetterHeaders and any extra headers of the message, so that it can be replayed.
+func newDeadLetter(msg queueConsumer.Message, err error, extraHeaders ...string) deadLetter {
+	dl := deadLetter{
+		ID:        newDeadLetterID(),
+		Timestamp: time.Now().UTC(),
+		Headers:   make(map[string]string),
+		Body:      msg.Body,
+		Error:     err.Error(),
+	}
+	headers := append(append([]string{}, deadLetterHeaders...), extraHeaders...)
+	for _, header := range headers {
+		if value, ok := msg.Headers[header]; ok {
+			dl.Headers[header] = value
+		}
+	}
+	if wErr, ok := err.(*writerError); ok {
+		dl.WriterURL = wErr.reqURL
+		dl.StatusCode = wErr.status
+		dl.ErrorBody = wErr.body
+	}
+	if vErr, ok := err.(*validationError); ok {
+		dl.ValidationErrors = vErr.errors
+	}
+	return dl
+}
+
+func newDeadLetterID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// deadLetterSink stores messages that the ingester has given up on, so they can be found and re-driven later.
+type deadLetterSink interface {
+	Send(dl deadLetter) error
+}
+
+// deadLetterStore is a deadLetterSink that can also be searched, so that dead letters can be replayed.
+type deadLetterStore interface {
+	deadLetterSink
+	List(filter deadLetterFilter) ([]deadLetter, error)
+	Remove(ids []string) error
+}
+
+// deadLetterFilter selects dead letters. Empty fields match everything.
+type deadLetterFilter struct {
+	IDs         []string
+	ConceptType string
+	UUID        string
+	// Writer matches any dead letter whose writer URL contains it
+	Writer string
+	From   time.Time
+	To     time.Time
+}
+
+func (f deadLetterFilter) matches(dl deadLetter) bool {
+	if len(f.IDs) > 0 && !containsString(f.IDs, dl.ID) {
+		return false
+	}
+	if f.ConceptType != "" && dl.Headers["Message-Type"] != f.ConceptType {
+		return false
+	}
+	if f.UUID != "" && dl.Headers["Message-Id"] != f.UUID {
+		return false
+	}
+	if f.Writer != "" && !strings.Contains(dl.WriterURL, f.Writer) {
+		return false
+	}
+	if !f.From.IsZero() && dl.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && dl.Timestamp.After(f.To) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (ing ingesterService) deadLetter(msg queueConsumer.Message, err error) bool {
+	// a dry run sets nothing aside, as if there was no dead-letter sink
+	if ing.dryRun != nil || ing.deadLetters == nil {
+		return false
+	}
+	ingestionType, uuid, _ := extractMessageTypeAndId(msg.Headers)
+	if sinkErr := ing.deadLetters.Send(newDeadLetter(msg, err, ing.stale.headers()...)); sinkErr != nil {
+		log.Errorf("Cannot dead-letter %s with uuid: %s: %v", ingestionType, uuid, sinkErr)
+		return false
+	}
+	deadLetterMeter := metrics.GetOrRegisterMeter(ingestionType+"-DEAD-LETTER", metrics.DefaultRegistry)
+	deadLetterMeter.Mark(1)
+	log.Infof("Dead-lettered %s with uuid: %s", ingestionType, uuid)
+	return true
+}
+
+// fileDeadLetterSink appends dead letters to a local file, one JSON document per line. It is meant for running locally.
+type fileDeadLetterSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newFileDeadLetterSink(path string) *fileDeadLetterSink {
+	return &fileDeadLetterSink{path: path}
+}
+
+func (s *fileDeadLetterSink) Send(dl deadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileDeadLetterSink) List(filter deadLetterFilter) ([]deadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	matching := make([]deadLetter, 0)
+	for _, dl := range all {
+		if filter.matches(dl) {
+			matching = append(matching, dl)
+		}
+	}
+	return matching, nil
+}
+
+// Remove rewrites the file without the given dead letters.
+func (s *fileDeadLetterSink) Remove(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.readAll()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	encoder := json.NewEncoder(tmp)
+	for _, dl := range all {
+		if containsString(ids, dl.ID) {
+			continue
+		}
+		if err := encoder.Encode(dl); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileDeadLetterSink) readAll() ([]deadLetter, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var all []deadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var dl deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			log.Warnf("Skipping unreadable dead letter in %s: %v", s.path, err)
+			continue
+		}
+		all = append(all, dl)
+	}
+	return all, scanner.Err()
+}
+
+// memoryDeadLetterStore keeps the most recent dead letters in memory, so that they can be replayed
+// while they are also sent on to a sink that cannot be searched, such as a Kafka topic.
+type memoryDeadLetterStore struct {
+	next        deadLetterSink
+	capacity    int
+	deadLetters []deadLetter
+	mu          sync.Mutex
+}
+
+func newMemoryDeadLetterStore(capacity int, next deadLetterSink) *memoryDeadLetterStore {
+	return &memoryDeadLetterStore{next: next, capacity: capacity}
+}
+
+func (s *memoryDeadLetterStore) Send(dl deadLetter) error {
+	if s.next != nil {
+		if err := s.next.Send(dl); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = append(s.deadLetters, dl)
+	if len(s.deadLetters) > s.capacity {
+		s.deadLetters = s.deadLetters[len(s.deadLetters)-s.capacity:]
+	}
+	return nil
+}
+
+func (s *memoryDeadLetterStore) List(filter deadLetterFilter) ([]deadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matching := make([]deadLetter, 0)
+	for _, dl := range s.deadLetters {
+		if filter.matches(dl) {
+			matching = append(matching, dl)
+		}
+	}
+	return matching, nil
+}
+
+func (s *memoryDeadLetterStore) Remove(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := s.deadLetters[:0]
+	for _, dl := range s.deadLetters {
+		if !containsString(ids, dl.ID) {
+			remaining = append(remaining, dl)
+		}
+	}
+	s.deadLetters = remaining
+	return nil
+}
+
+// proxyDeadLetterSink publishes dead letters to a Kafka topic through the same kafka-rest-proxy the consumer reads from.
+type proxyDeadLetterSink struct {
+	addr   string
+	queue  string
+	topic  string
+	client *http.Client
+}
+
+func newProxyDeadLetterSink(addr string, queue string, topic string, client *http.Client) *proxyDeadLetterSink {
+	return &proxyDeadLetterSink{addr: addr, queue: queue, topic: topic, client: client}
+}
+
+type proxyRecords struct {
+	Records []proxyRecord `json:"records"`
+}
+
+type proxyRecord struct {
+	Value string `json:"value"`
+}
+
+func (s *proxyDeadLetterSink) Send(dl deadLetter) error {
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	for name, value := range dl.Headers {
+		headers[name] = value
+	}
+	records, err := json.Marshal(proxyRecords{Records: []proxyRecord{{Value: base64.StdEncoding.EncodeToString(encodeFTMessage(headers, string(body)))}}})
+	if err != nil {
+		return err
+	}
+
+	reqURL := s.addr + "/topics/" + s.topic
+	request, err := http.NewRequest("POST", reqURL, bytes.NewReader(records))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.binary.v1+json")
+	if s.queue != "" {
+		request.Host = s.queue
+	}
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("reqURL=[%s] error=[%v]", reqURL, err)
+	}
+	defer readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reqURL=[%s] status=[%d]", reqURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// encodeFTMessage renders a message in the FTMSG/1.0 format used on the UPP Kafka topics.
+func encodeFTMessage(headers map[string]string, body string) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msg bytes.Buffer
+	msg.WriteString("FTMSG/1.0\r\n")
+	for _, name := range names {
+		msg.WriteString(name + ": " + strings.Replace(headers[name], "\n", " ", -1) + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+	return msg.Bytes()
+}
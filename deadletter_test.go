@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedMessageIsDeadLettered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"invalid concept"}`))
+	}))
+	defer server.Close()
+
+	sink := &mockDeadLetterSink{}
+	deadLetterMeterInitialCount := getDeadLetterCount()
+
+	ing := ingesterService{
+		routes:      mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:      &http.Client{},
+		deadLetters: sink,
+	}
+	ing.readMessage(createMessage(uuid, validMessageTypeOrganisations))
+
+	assert := assert.New(t)
+	require.Len(t, sink.deadLetters, 1)
+	dl := sink.deadLetters[0]
+	assert.Equal(`{transformed-org-json`, dl.Body)
+	assert.Equal(map[string]string{"Message-Type": "organisations", "Message-Id": uuid, "X-Request-Id": "tid_newid"}, dl.Headers)
+	assert.Equal(server.URL+"/organisations/"+uuid, dl.WriterURL)
+	assert.Equal(http.StatusBadRequest, dl.StatusCode)
+	assert.Equal(`{"message":"invalid concept"}`, dl.ErrorBody)
+	assert.Equal(int64(1), getDeadLetterCount()-deadLetterMeterInitialCount, "Should have incremented DeadLetterCount by 1")
+}
+
+func TestSuccessfulMessageIsNotDeadLettered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:      mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:      &http.Client{},
+		deadLetters: sink,
+	}
+	ing.readMessage(createMessage(uuid, validMessageTypeOrganisations))
+
+	assert.Empty(t, sink.deadLetters)
+}
+
+func TestUnroutableMessageIsDeadLettered(t *testing.T) {
+	sink := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:      mustRoutingTable(correctWriterMappings, ""),
+		client:      &http.Client{},
+		deadLetters: sink,
+	}
+	ing.readMessage(createMessage(uuid, invalidMessageType))
+
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, "No configured writer for concept: animals", sink.deadLetters[0].Error)
+	assert.Empty(t, sink.deadLetters[0].WriterURL)
+}
+
+func TestFileDeadLetterSinkAppendsOneLinePerDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead-letters.ndjson")
+
+	sink := newFileDeadLetterSink(path)
+	require.NoError(t, sink.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("first"))))
+	require.NoError(t, sink.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("second"))))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var dl deadLetter
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &dl))
+		errs = append(errs, dl.Error)
+	}
+	assert.Equal(t, []string{"first", "second"}, errs)
+}
+
+func TestProxyDeadLetterSinkPublishesToTopic(t *testing.T) {
+	var request *http.Request
+	var records proxyRecords
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		json.NewDecoder(r.Body).Decode(&records)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sink := newProxyDeadLetterSink(server.URL, "kafka", "ConceptIngesterDeadLetters", &http.Client{})
+	err := sink.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), &writerError{reqURL: "http://writer/organisations/" + uuid, status: 503}))
+
+	assert := assert.New(t)
+	require.NoError(t, err)
+	assert.Equal("/topics/ConceptIngesterDeadLetters", request.URL.Path)
+	assert.Equal("kafka", request.Host)
+	assert.Equal("application/vnd.kafka.binary.v1+json", request.Header.Get("Content-Type"))
+	require.Len(t, records.Records, 1)
+
+	value, err := base64.StdEncoding.DecodeString(records.Records[0].Value)
+	require.NoError(t, err)
+	assert.True(strings.HasPrefix(string(value), "FTMSG/1.0\r\n"))
+	assert.Contains(string(value), "Message-Id: "+uuid+"\r\n")
+	assert.Contains(string(value), `"writerUrl":"http://writer/organisations/`+uuid+`"`)
+	assert.Contains(string(value), `"statusCode":503`)
+}
+
+func TestProxyDeadLetterSinkReportsProxyFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink := newProxyDeadLetterSink(server.URL, "", "ConceptIngesterDeadLetters", &http.Client{})
+	err := sink.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("failed")))
+
+	assert.Error(t, err)
+}
+
+func TestFileDeadLetterSinkListsAndRemovesDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := newFileDeadLetterSink(filepath.Join(dir, "dead-letters.ndjson"))
+	first := newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("first"))
+	second := newDeadLetter(createMessage(uuid, "people"), errors.New("second"))
+	require.NoError(t, sink.Send(first))
+	require.NoError(t, sink.Send(second))
+
+	people, err := sink.List(deadLetterFilter{ConceptType: "people"})
+	require.NoError(t, err)
+	require.Len(t, people, 1)
+	assert.Equal(t, second.ID, people[0].ID)
+
+	require.NoError(t, sink.Remove([]string{first.ID}))
+	remaining, err := sink.List(deadLetterFilter{})
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, second.ID, remaining[0].ID)
+}
+
+func getDeadLetterCount() int64 {
+	return metrics.GetOrRegisterMeter("organisations-DEAD-LETTER", metrics.DefaultRegistry).Count()
+}
+
+type mockDeadLetterSink struct {
+	deadLetters []deadLetter
+}
+
+func (s *mockDeadLetterSink) Send(dl deadLetter) error {
+	s.deadLetters = append(s.deadLetters, dl)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// dedupStore remembers what was last processed for each concept, so that redelivered and republished messages can
+// be skipped. Implementations must be safe for concurrent use.
+type dedupStore interface {
+	// Get returns the value last put for the key, unless it has expired since
+	Get(key string) (string, bool, error)
+	Put(key string, value string) error
+}
+
+// deduplicator skips messages that were processed recently.
+type deduplicator struct {
+	store dedupStore
+	// hashBody compares a hash of the body too, so that a message with the same Message-Id but a different concept,
+	// e.g. an update, is not skipped
+	hashBody bool
+}
+
+func newDeduplicator(store dedupStore, hashBody bool) *deduplicator {
+	return &deduplicator{store: store, hashBody: hashBody}
+}
+
+func dedupKey(msg delivery) string {
+	return msg.ingestionType + "/" + msg.uuid
+}
+
+// value identifies what was done to the concept, so that a write after a delete, or an update when the body is
+// hashed, is not a duplicate.
+func (d *deduplicator) value(msg delivery) string {
+	if msg.deleted {
+		return "deleted"
+	}
+	if !d.hashBody {
+		return "written"
+	}
+	sum := sha256.Sum256([]byte(msg.body))
+	return hex.EncodeToString(sum[:])
+}
+
+// duplicate reports whether the message was processed recently. A nil deduplicator never finds duplicates, and
+// neither does one whose store fails, so that a broken store does not lose messages.
+func (d *deduplicator) duplicate(msg delivery) bool {
+	if d == nil {
+		return false
+	}
+	value, ok, err := d.store.Get(dedupKey(msg))
+	if err != nil {
+		log.Warnf("Cannot check whether %s with uuid: %s is a duplicate: %v", msg.ingestionType, msg.uuid, err)
+		return false
+	}
+	seen := ok && value == d.value(msg)
+	if seen {
+		duplicateMeter := metrics.GetOrRegisterMeter(msg.ingestionType+"-DUPLICATE", metrics.DefaultRegistry)
+		duplicateMeter.Mark(1)
+		log.Infof("Skipping duplicate %s with uuid: %s", msg.ingestionType, msg.uuid)
+	}
+	return seen
+}
+
+// processed records a message that was delivered. A nil deduplicator records nothing.
+func (d *deduplicator) processed(msg delivery) {
+	if d == nil {
+		return
+	}
+	if err := d.store.Put(dedupKey(msg), d.value(msg)); err != nil {
+		log.Warnf("Cannot record %s with uuid: %s as processed: %v", msg.ingestionType, msg.uuid, err)
+	}
+}
+
+// memoryDedupStore is a dedupStore that keeps up to capacity keys in memory for ttl after they were last put. Once it
+// is full the oldest key is forgotten.
+type memoryDedupStore struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+
+	mu    sync.Mutex
+	keys  map[string]*list.Element
+	order *list.List
+}
+
+type dedupEntry struct {
+	key   string
+	value string
+	added time.Time
+}
+
+func newMemoryDedupStore(ttl time.Duration, capacity int) *memoryDedupStore {
+	return &memoryDedupStore{
+		ttl:      ttl,
+		capacity: capacity,
+		now:      time.Now,
+		keys:     make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (s *memoryDedupStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	element, ok := s.keys[key]
+	if !ok {
+		return "", false, nil
+	}
+	return element.Value.(dedupEntry).value, true, nil
+}
+
+func (s *memoryDedupStore) Put(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.keys[key]; ok {
+		s.order.Remove(element)
+	}
+	s.keys[key] = s.order.PushBack(dedupEntry{key: key, value: value, added: s.now()})
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Front())
+	}
+	return nil
+}
+
+// expire forgets the keys that were added more than ttl ago. s.mu must be held.
+func (s *memoryDedupStore) expire() {
+	cutoff := s.now().Add(-s.ttl)
+	for front := s.order.Front(); front != nil && !front.Value.(dedupEntry).added.After(cutoff); front = s.order.Front() {
+		s.remove(front)
+	}
+}
+
+func (s *memoryDedupStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.keys, element.Value.(dedupEntry).key)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDedupStoreExpiresKeys(t *testing.T) {
+	now := time.Now()
+	store := newMemoryDedupStore(time.Minute, 10)
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.Put("a", "1"))
+	value, ok, err := store.Get("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+
+	now = now.Add(time.Minute)
+	_, ok, _ = store.Get("a")
+	assert.False(t, ok, "Keys should be forgotten after the TTL")
+}
+
+func TestMemoryDedupStoreIsBounded(t *testing.T) {
+	store := newMemoryDedupStore(time.Hour, 2)
+	store.Put("a", "1")
+	store.Put("b", "1")
+	store.Put("a", "2")
+	store.Put("c", "1")
+
+	_, ok, _ := store.Get("b")
+	assert.False(t, ok, "The oldest key should be forgotten once the store is full")
+	value, ok, _ := store.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "2", value)
+	_, ok, _ = store.Get("c")
+	assert.True(t, ok)
+}
+
+func TestDuplicateMessagesAreSkipped(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:  mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:  &http.Client{},
+		deletes: deleteDetector{typeSuffix: "-deleted"},
+		dedup:   newDeduplicator(newMemoryDedupStore(time.Hour, 10), true),
+	}
+	duplicateCount := getDuplicateCount()
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Body = `{"uuid": "` + uuid + `", "prefLabel": "FT"}`
+	deleted := createMessage(uuid, "organisations-deleted")
+	deleted.Body = ""
+	updated := createMessage(uuid, validMessageTypeOrganisations)
+	updated.Body = `{"uuid": "` + uuid + `", "prefLabel": "Financial Times"}`
+
+	for i, step := range []struct {
+		msg   queueConsumer.Message
+		calls int
+	}{{msg, 1}, {msg, 1}, {deleted, 2}, {msg, 3}, {updated, 4}, {updated, 4}} {
+		_, err := ing.processMessage(context.Background(), step.msg)
+		require.NoError(t, err)
+		assert.Equal(t, step.calls, calls, "Writer calls after message %d", i)
+	}
+	assert.Equal(t, int64(2), getDuplicateCount()-duplicateCount)
+}
+
+func TestFailedMessagesAreNotDuplicates(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client: &http.Client{},
+		dedup:  newDeduplicator(newMemoryDedupStore(time.Hour, 10), false),
+	}
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+
+	_, err := ing.processMessage(context.Background(), msg)
+	assert.Error(t, err)
+	_, err = ing.processMessage(context.Background(), msg)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls, "A message that failed should be tried again when it is redelivered")
+}
+
+func getDuplicateCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-DUPLICATE", metrics.DefaultRegistry).Count()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// deleteDetector recognises messages that retract a concept instead of publishing it.
+type deleteDetector struct {
+	// typeSuffix marks a deletion in the Message-Type, e.g. organisations-deleted
+	typeSuffix string
+	emptyBody  bool
+	// markerField and markerValue mark a deletion when the top-level JSON field has that value
+	markerField string
+	markerValue string
+}
+
+// newDeleteDetector builds a deleteDetector. marker is either empty or field=value.
+func newDeleteDetector(typeSuffix string, emptyBody bool, marker string) (deleteDetector, error) {
+	dd := deleteDetector{typeSuffix: typeSuffix, emptyBody: emptyBody}
+	if marker != "" {
+		parts := strings.SplitN(marker, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return dd, fmt.Errorf("Invalid delete marker %q, expected field=value", marker)
+		}
+		dd.markerField, dd.markerValue = parts[0], parts[1]
+	}
+	return dd, nil
+}
+
+// detect returns the message type without any deletion suffix, and whether the message is a deletion.
+func (dd deleteDetector) detect(ingestionType string, body string) (string, bool) {
+	if dd.typeSuffix != "" && strings.HasSuffix(ingestionType, dd.typeSuffix) {
+		return strings.TrimSuffix(ingestionType, dd.typeSuffix), true
+	}
+	if dd.emptyBody && strings.TrimSpace(body) == "" {
+		return ingestionType, true
+	}
+	if dd.markerField != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &fields); err == nil {
+			if value, ok := fields[dd.markerField]; ok && fmt.Sprint(value) == dd.markerValue {
+				return ingestionType, true
+			}
+		}
+	}
+	return ingestionType, false
+}
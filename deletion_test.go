@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteDetection(t *testing.T) {
+	dd, err := newDeleteDetector("-deleted", true, "deleted=true")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		ingestionType   string
+		body            string
+		expectedType    string
+		expectedDeleted bool
+	}{
+		{"Type suffix", "organisations-deleted", `{"uuid":"` + uuid + `"}`, "organisations", true},
+		{"Empty body", "organisations", "", "organisations", true},
+		{"Whitespace body", "organisations", " \n", "organisations", true},
+		{"JSON marker", "organisations", `{"uuid":"` + uuid + `","deleted":true}`, "organisations", true},
+		{"JSON marker with another value", "organisations", `{"uuid":"` + uuid + `","deleted":false}`, "organisations", false},
+		{"Upsert", "organisations", `{"uuid":"` + uuid + `"}`, "organisations", false},
+		{"Body that is not JSON", "organisations", `{transformed-org-json`, "organisations", false},
+	}
+
+	for _, test := range tests {
+		ingestionType, deleted := dd.detect(test.ingestionType, test.body)
+		assert.Equal(t, test.expectedType, ingestionType, test.name)
+		assert.Equal(t, test.expectedDeleted, deleted, test.name)
+	}
+}
+
+func TestZeroDeleteDetectorTreatsEverythingAsAnUpsert(t *testing.T) {
+	ingestionType, deleted := deleteDetector{}.detect("organisations-deleted", "")
+	assert.Equal(t, "organisations-deleted", ingestionType)
+	assert.False(t, deleted)
+}
+
+func TestInvalidDeleteMarkerIsRejected(t *testing.T) {
+	_, err := newDeleteDetector("", false, "deleted")
+	assert.Error(t, err)
+}
+
+func TestDeletionIsSentToEveryDestination(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	deleteSuccessInitialCount := getDeleteSuccessCount()
+	dd, _ := newDeleteDetector("-deleted", true, "")
+	ing := ingesterService{
+		routes:  mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, server.URL+"/bulk"),
+		client:  &http.Client{},
+		deletes: dd,
+	}
+
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, "organisations-deleted"))
+
+	assert.NoError(t, err, "A 404 means the concept is already gone")
+	assert.Equal(t, []string{"DELETE /organisations/" + uuid, "DELETE /organisations/" + uuid}, requests, "Elasticsearch deletes should bypass the bulk endpoint")
+	assert.Equal(t, int64(1), getDeleteSuccessCount()-deleteSuccessInitialCount, "Should have incremented DeleteSuccessCount by 1")
+}
+
+func TestFailedDeletionIsMetered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	deleteFailureMeter := metrics.GetOrRegisterMeter("organisations-DELETE-FAILURE", metrics.DefaultRegistry)
+	deleteFailureInitialCount := deleteFailureMeter.Count()
+	_, failureMeterInitialCount := getCounts()
+	dd, _ := newDeleteDetector("-deleted", true, "")
+	ing := ingesterService{
+		routes:  mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:  &http.Client{},
+		deletes: dd,
+	}
+
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, "organisations-deleted"))
+
+	_, failureMeterFinalCount := getCounts()
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), deleteFailureMeter.Count()-deleteFailureInitialCount, "Should have incremented DeleteFailureCount by 1")
+	assert.Equal(t, failureMeterInitialCount, failureMeterFinalCount, "Should not have incremented FailureCount")
+}
+
+func getDeleteSuccessCount() int64 {
+	return metrics.GetOrRegisterMeter("organisations-DELETE-SUCCESS", metrics.DefaultRegistry).Count()
+}
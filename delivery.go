@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// delivery is a message on its way to its destinations.
+type delivery struct {
+	ingestionType string
+	uuid          string
+	transactionID string
+	body          string
+	// deleted is true when the concept should be deleted from its destinations rather than written
+	deleted bool
+	// force writes the concept even if a destination already has the same content
+	force bool
+}
+
+// outcome returns the meter suffix for an outcome, distinguishing deletes from writes.
+func (d delivery) outcome(name string) string {
+	if d.deleted {
+		return "DELETE-" + name
+	}
+	return name
+}
+
+// deliveryOutcome records what happened when a message was delivered to one of its destinations.
+type deliveryOutcome struct {
+	Destination string
+	URL         string
+	Required    bool
+	// Skipped is true when the destination was not tried because a destination it depends on failed
+	Skipped bool
+	// Unchanged is true when the write was not sent because the destination already has the same content
+	Unchanged bool
+	Err       error
+}
+
+// deliveryTimeouts are the default timeouts of destinations that don't set their own. Zero means no timeout.
+type deliveryTimeouts struct {
+	// total bounds a delivery to a destination, retries included
+	total time.Duration
+	// attempt bounds a single call to a destination
+	attempt time.Duration
+}
+
+// withTimeout is context.WithTimeout, except that a timeout that is not positive means no timeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// deliverSequentially delivers to one destination after the other. Once a required destination fails the rest are
+// skipped, as is any destination whose after list names a destination that did not succeed.
+func (ing ingesterService) deliverSequentially(ctx context.Context, d delivery, destinations []destination) []deliveryOutcome {
+	outcomes := make([]deliveryOutcome, 0, len(destinations))
+	succeeded := make(map[string]bool, len(destinations))
+	failed := false
+	for _, dest := range destinations {
+		if failed || !allSucceeded(dest.After, succeeded) {
+			outcomes = append(outcomes, skippedOutcome(d, dest))
+			continue
+		}
+		outcome := ing.deliver(ctx, d, dest)
+		failed = outcome.Err != nil && dest.Required
+		succeeded[dest.Name] = outcome.Err == nil
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+func allSucceeded(names []string, succeeded map[string]bool) bool {
+	for _, name := range names {
+		if !succeeded[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// deliverInParallel delivers to every destination concurrently. A destination with an after list waits for those
+// destinations and is skipped unless all of them succeed.
+func (ing ingesterService) deliverInParallel(ctx context.Context, d delivery, destinations []destination) []deliveryOutcome {
+	outcomes := make([]deliveryOutcome, len(destinations))
+	done := make(map[string]chan struct{}, len(destinations))
+	index := make(map[string]int, len(destinations))
+	for i, dest := range destinations {
+		done[dest.Name] = make(chan struct{})
+		index[dest.Name] = i
+	}
+
+	var wg sync.WaitGroup
+	for i, dest := range destinations {
+		wg.Add(1)
+		go func(i int, dest destination) {
+			defer wg.Done()
+			defer close(done[dest.Name])
+			for _, name := range dest.After {
+				<-done[name]
+				if dependency := outcomes[index[name]]; dependency.Err != nil || dependency.Skipped {
+					outcomes[i] = skippedOutcome(d, dest)
+					return
+				}
+			}
+			outcomes[i] = ing.deliver(ctx, d, dest)
+		}(i, dest)
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// deliver sends the message to a single destination, retrying transient failures, and meters the result.
+// The delivery, retries included, is bounded by the destination's timeout and each attempt by its attempt timeout.
+func (ing ingesterService) deliver(ctx context.Context, d delivery, dest destination) deliveryOutcome {
+	outcome := deliveryOutcome{Destination: dest.Name, URL: dest.url(d.ingestionType, d.uuid), Required: dest.Required}
+	if ing.dryRun != nil {
+		outcome.Err = ing.dryRun.send(ctx, d, dest)
+		return outcome
+	}
+	if ing.fingerprints.unchanged(d, dest) {
+		outcome.Unchanged = true
+		return outcome
+	}
+	ctx, cancel := withTimeout(ctx, dest.timeout(ing.timeouts.total))
+	defer cancel()
+	outcome.Err = ing.retry.do(ctx, dest.meterName(d.ingestionType, d.outcome("RETRY")), func() error {
+		if err := ing.breakers.allow(ctx, dest.HealthURL); err != nil {
+			return err
+		}
+		ing.limits.wait(writerLimit, dest.HealthURL)
+		attemptCtx, cancelAttempt := withTimeout(ctx, dest.attemptTimeout(ing.timeouts.attempt))
+		defer cancelAttempt()
+		start := time.Now()
+		var err error
+		if ing.bulk != nil && dest.BulkURLTemplate != "" && !d.deleted {
+			err = ing.bulk.write(attemptCtx, d, dest)
+		} else {
+			err = sendToWriter(attemptCtx, d, dest, ing.client)
+		}
+		ing.adaptive.observe(dest.HealthURL, time.Since(start), err)
+		ing.breakers.record(dest.HealthURL, err)
+		return err
+	})
+	ing.fingerprints.record(d, dest, outcome.Err)
+	if outcome.Err != nil {
+		failureMeter := metrics.GetOrRegisterMeter(dest.meterName(d.ingestionType, d.outcome("FAILURE")), metrics.DefaultRegistry)
+		failureMeter.Mark(1)
+		log.Infof("Incremented failure count, new count=%d for meter=%s", failureMeter.Count(), dest.meterName(d.ingestionType, d.outcome("FAILURE")))
+	} else if dest.Name != neo4jDestination {
+		metrics.GetOrRegisterMeter(dest.meterName(d.ingestionType, d.outcome("SUCCESS")), metrics.DefaultRegistry).Mark(1)
+	}
+	return outcome
+}
+
+func skippedOutcome(d delivery, dest destination) deliveryOutcome {
+	return deliveryOutcome{Destination: dest.Name, URL: dest.url(d.ingestionType, d.uuid), Required: dest.Required, Skipped: true}
+}
+
+// requiredDeliveryError returns the error of the first required destination that failed or was skipped.
+func requiredDeliveryError(outcomes []deliveryOutcome) error {
+	for _, outcome := range outcomes {
+		if outcome.Required && outcome.Err != nil {
+			return outcome.Err
+		}
+	}
+	for _, outcome := range outcomes {
+		if outcome.Required && outcome.Skipped {
+			return fmt.Errorf("Delivery to %s was skipped because a destination it depends on failed", outcome.Destination)
+		}
+	}
+	return nil
+}
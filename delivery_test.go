@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelDeliveryOverlapsIndependentDestinations(t *testing.T) {
+	var inFlight, maxInFlight int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/neo4j/{uuid}", Method: "PUT", Required: true},
+		{Name: elasticsearchDestination, URLTemplate: server.URL + "/bulk/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: "public-concepts-cache", URLTemplate: server.URL + "/cache/{uuid}", Method: "PUT"},
+	})
+
+	ing := ingesterService{routes: routes, client: &http.Client{}, parallelDelivery: true}
+	outcomes, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	require.NoError(t, err)
+	assert.Len(t, outcomes, 3)
+	assert.Equal(t, 3, maxInFlight, "All destinations should have been written to at the same time")
+}
+
+func TestParallelDeliveryWaitsForDependencies(t *testing.T) {
+	var paths []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/neo4j") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL + "/neo4j"}, server.URL+"/bulk"), client: &http.Client{}, parallelDelivery: true}
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/neo4j/organisations/" + uuid, "/bulk/organisations/" + uuid}, paths, "Elasticsearch should only be written once neo4j has succeeded")
+}
+
+func TestParallelDeliverySkipsDestinationsWhoseDependencyFailed(t *testing.T) {
+	var elasticsearchCalled bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/bulk") {
+			elasticsearchCalled = true
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, failureMeterInitialCount := getCounts()
+	elasticsearchFailureInitialCount := getElasticsearchCount()
+
+	ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, server.URL+"/bulk"), client: &http.Client{}, parallelDelivery: true}
+	outcomes, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert := assert.New(t)
+	assert.Error(err)
+	assert.False(elasticsearchCalled)
+	require.Len(t, outcomes, 2)
+	assert.Error(outcomes[0].Err)
+	assert.True(outcomes[1].Skipped)
+
+	_, failureMeterFinalCount := getCounts()
+	assert.Equal(int64(1), failureMeterFinalCount-failureMeterInitialCount, "The neo4j failure should be attributed to neo4j")
+	assert.Equal(int64(0), getElasticsearchCount()-elasticsearchFailureInitialCount, "A skipped destination is not a failure")
+}
+
+func TestParallelDeliveryAttributesFailuresToTheRightDestination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/bulk") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, failureMeterInitialCount := getCounts()
+	elasticsearchFailureInitialCount := getElasticsearchCount()
+
+	ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, server.URL+"/bulk"), client: &http.Client{}, parallelDelivery: true}
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert.Error(t, err)
+	_, failureMeterFinalCount := getCounts()
+	assert.Equal(t, int64(0), failureMeterFinalCount-failureMeterInitialCount)
+	assert.Equal(t, int64(1), getElasticsearchCount()-elasticsearchFailureInitialCount)
+}
+
+func TestRequiredDestinationSkippedAfterBestEffortFailureFailsTheMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: "public-concepts-cache", URLTemplate: server.URL + "/cache/{uuid}", Method: "PUT"},
+		{Name: neo4jDestination, URLTemplate: server.URL + "/neo4j/{uuid}", Method: "PUT", Required: true, After: []string{"public-concepts-cache"}},
+	})
+	successMeterInitialCount, _ := getCounts()
+
+	for _, parallel := range []bool{false, true} {
+		ing := ingesterService{routes: routes, client: &http.Client{}, parallelDelivery: parallel}
+		outcomes, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+		assert.EqualError(t, err, "Delivery to neo4j was skipped because a destination it depends on failed")
+		require.Len(t, outcomes, 2)
+		assert.True(t, outcomes[1].Skipped)
+	}
+	successMeterFinalCount, _ := getCounts()
+	assert.Equal(t, successMeterInitialCount, successMeterFinalCount)
+}
+
+// hangingWriter accepts requests and never answers them, until the caller gives up on them.
+func hangingWriter() (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// the request is only cancelled when the client goes away once its body has been read
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	return server, &calls
+}
+
+func TestHangingWriterAttemptsTimeOutAndAreRetried(t *testing.T) {
+	server, calls := hangingWriter()
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{uuid}", Method: "PUT", Required: true, AttemptTimeoutMs: 20},
+	})
+	ing := ingesterService{routes: routes, client: &http.Client{}, retry: retryPolicy{maxAttempts: 3, baseBackoff: time.Millisecond}}
+
+	start := time.Now()
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	require.Error(t, err)
+	assert.True(t, isTransient(err), "A timed out attempt should be retried like a connection error")
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	assert.True(t, time.Since(start) < time.Second, "The attempts should have timed out")
+}
+
+func TestDeliveryTimeoutBoundsRetries(t *testing.T) {
+	server, calls := hangingWriter()
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{uuid}", Method: "PUT", Required: true, TimeoutMs: 100},
+	})
+	ing := ingesterService{
+		routes:   routes,
+		client:   &http.Client{},
+		retry:    retryPolicy{maxAttempts: 100, baseBackoff: time.Millisecond, maxBackoff: time.Millisecond},
+		timeouts: deliveryTimeouts{attempt: 30 * time.Millisecond},
+	}
+
+	start := time.Now()
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	require.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "The delivery should have given up once its timeout passed")
+	assert.True(t, atomic.LoadInt32(calls) < 10, "No more attempts should be made once the delivery has timed out")
+}
+
+func TestCancelledMessageIsNotRetried(t *testing.T) {
+	server, calls := hangingWriter()
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{uuid}", Method: "PUT", Required: true},
+	})
+	ing := ingesterService{routes: routes, client: &http.Client{}, retry: retryPolicy{maxAttempts: 3, baseBackoff: time.Hour}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := ing.processMessage(ctx, createMessage(uuid, validMessageTypeOrganisations))
+
+	require.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
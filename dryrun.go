@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRunRecentRequests is how many of the requests that would have been sent are kept for the report.
+const dryRunRecentRequests = 100
+
+// dryRunRecorder replaces the calls to the writers in a dry run. Messages are routed and their requests built and
+// validated as usual, but the requests are recorded instead of sent.
+type dryRunRecorder struct {
+	mu            sync.Mutex
+	since         time.Time
+	types         map[string]*dryRunTypeReport
+	routingErrors map[string]*dryRunRoutingError
+	recent        []dryRunRequest
+}
+
+type dryRunReport struct {
+	Since         time.Time                      `json:"since"`
+	Types         map[string]*dryRunTypeReport   `json:"types"`
+	RoutingErrors map[string]*dryRunRoutingError `json:"routingErrors"`
+	// Recent lists the last requests that would have been sent, oldest first
+	Recent []dryRunRequest `json:"recent"`
+}
+
+type dryRunTypeReport struct {
+	Messages int `json:"messages"`
+	// Invalid counts the messages whose payload is not valid JSON
+	Invalid int `json:"invalid"`
+	// Requests counts the requests that would have been sent to each destination
+	Requests map[string]int `json:"requests"`
+}
+
+type dryRunRoutingError struct {
+	Count int    `json:"count"`
+	Error string `json:"error"`
+}
+
+type dryRunRequest struct {
+	Time          time.Time `json:"time"`
+	IngestionType string    `json:"type"`
+	UUID          string    `json:"uuid"`
+	Destination   string    `json:"destination"`
+	Method        string    `json:"method"`
+	URL           string    `json:"url"`
+}
+
+func newDryRunRecorder() *dryRunRecorder {
+	r := &dryRunRecorder{}
+	r.reset()
+	return r
+}
+
+func (r *dryRunRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.since = time.Now()
+	r.types = make(map[string]*dryRunTypeReport)
+	r.routingErrors = make(map[string]*dryRunRoutingError)
+	r.recent = nil
+}
+
+// typeReport returns the report for a message type, creating it if needed. r.mu must be held.
+func (r *dryRunRecorder) typeReport(ingestionType string) *dryRunTypeReport {
+	report, ok := r.types[ingestionType]
+	if !ok {
+		report = &dryRunTypeReport{Requests: make(map[string]int)}
+		r.types[ingestionType] = report
+	}
+	return report
+}
+
+// message records a message that was routed. A nil dryRunRecorder records nothing.
+func (r *dryRunRecorder) message(ingestionType string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.typeReport(ingestionType).Messages++
+}
+
+// routingError records a message that could not be routed. A nil dryRunRecorder records nothing.
+func (r *dryRunRecorder) routingError(ingestionType string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routingErr, ok := r.routingErrors[ingestionType]
+	if !ok {
+		routingErr = &dryRunRoutingError{}
+		r.routingErrors[ingestionType] = routingErr
+	}
+	routingErr.Count++
+	routingErr.Error = err.Error()
+}
+
+// send builds the request for the destination as sendToWriter would, checks the payload and records the request.
+func (r *dryRunRecorder) send(ctx context.Context, d delivery, dest destination) error {
+	var request *http.Request
+	var err error
+	if d.deleted {
+		request, _, err = createDeleteRequest(ctx, d.ingestionType, d.uuid, dest)
+	} else {
+		request, _, err = createWriteRequest(ctx, d.ingestionType, strings.NewReader(d.body), d.uuid, dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.typeReport(d.ingestionType)
+	if !d.deleted && !json.Valid([]byte(d.body)) {
+		report.Invalid++
+		return fmt.Errorf("Invalid JSON payload for %s with uuid %s", d.ingestionType, d.uuid)
+	}
+	report.Requests[dest.Name]++
+	r.recent = append(r.recent, dryRunRequest{
+		Time:          time.Now(),
+		IngestionType: d.ingestionType,
+		UUID:          d.uuid,
+		Destination:   dest.Name,
+		Method:        request.Method,
+		URL:           request.URL.String(),
+	})
+	if len(r.recent) > dryRunRecentRequests {
+		r.recent = r.recent[len(r.recent)-dryRunRecentRequests:]
+	}
+	log.Infof("Dry run: would have sent %s %s for %s with uuid: %s", request.Method, request.URL, d.ingestionType, d.uuid)
+	return nil
+}
+
+func (r *dryRunRecorder) report() dryRunReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := dryRunReport{
+		Since:         r.since,
+		Types:         make(map[string]*dryRunTypeReport, len(r.types)),
+		RoutingErrors: make(map[string]*dryRunRoutingError, len(r.routingErrors)),
+		Recent:        append([]dryRunRequest{}, r.recent...),
+	}
+	for ingestionType, typeReport := range r.types {
+		requests := make(map[string]int, len(typeReport.Requests))
+		for dest, count := range typeReport.Requests {
+			requests[dest] = count
+		}
+		report.Types[ingestionType] = &dryRunTypeReport{Messages: typeReport.Messages, Invalid: typeReport.Invalid, Requests: requests}
+	}
+	for ingestionType, routingErr := range r.routingErrors {
+		copied := *routingErr
+		report.RoutingErrors[ingestionType] = &copied
+	}
+	return report
+}
+
+// dryRunHandler serves the dry-run report on /__dry-run. DELETE starts a new report.
+type dryRunHandler struct {
+	recorder *dryRunRecorder
+}
+
+func (h *dryRunHandler) registerHandlers(r *mux.Router) {
+	r.HandleFunc("/__dry-run", h.getReport).Methods("GET")
+	r.HandleFunc("/__dry-run", h.resetReport).Methods("DELETE")
+}
+
+func (h *dryRunHandler) getReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.recorder.report())
+}
+
+func (h *dryRunHandler) resetReport(w http.ResponseWriter, r *http.Request) {
+	h.recorder.reset()
+	writeJSON(w, http.StatusOK, h.recorder.report())
+}
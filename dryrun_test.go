@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunRecordsRequestsInsteadOfSendingThem(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: "public-concepts-cache", URLTemplate: server.URL + "/cache/{uuid}", Method: "POST"},
+	})
+	ing := ingesterService{routes: routes, client: &http.Client{}, dryRun: newDryRunRecorder(), deletes: deleteDetector{typeSuffix: "-deleted"}}
+
+	valid := createMessage(uuid, validMessageTypeOrganisations)
+	valid.Body = `{"uuid": "` + uuid + `"}`
+	_, err := ing.processMessage(context.Background(), valid)
+	require.NoError(t, err)
+
+	invalid := createMessage(otherUUID, validMessageTypeOrganisations)
+	invalid.Body = `{"uuid": `
+	_, err = ing.processMessage(context.Background(), invalid)
+	assert.Error(t, err, "A payload that is not JSON should fail")
+
+	deleted := createMessage(otherUUID, "organisations-deleted")
+	deleted.Body = ""
+	_, err = ing.processMessage(context.Background(), deleted)
+	require.NoError(t, err)
+
+	_, err = ing.processMessage(context.Background(), createMessage(uuid, "brands"))
+	assert.Error(t, err)
+
+	assert.False(t, called, "Nothing should be sent in a dry run")
+	report := ing.dryRun.report()
+	assert.Equal(t, 3, report.Types["organisations"].Messages)
+	assert.Equal(t, 1, report.Types["organisations"].Invalid)
+	assert.Equal(t, map[string]int{neo4jDestination: 2, "public-concepts-cache": 2}, report.Types["organisations"].Requests)
+	require.Contains(t, report.RoutingErrors, "brands")
+	assert.Equal(t, 1, report.RoutingErrors["brands"].Count)
+
+	require.Len(t, report.Recent, 4)
+	assert.Equal(t, dryRunRequest{Time: report.Recent[0].Time, IngestionType: "organisations", UUID: uuid, Destination: neo4jDestination, Method: "PUT", URL: server.URL + "/organisations/" + uuid}, report.Recent[0])
+	assert.Equal(t, "DELETE", report.Recent[2].Method)
+}
+
+func TestDryRunLeavesTheSuccessAndFailureMetersAlone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: elasticsearchDestination, URLTemplate: server.URL + "/bulk/{type}/{uuid}", Method: "PUT", Required: true},
+	})
+	ing := ingesterService{routes: routes, client: &http.Client{}, dryRun: newDryRunRecorder()}
+	meterNames := []string{"organisations-SUCCESS", "organisations-FAILURE", "organisations-elasticsearch-SUCCESS",
+		"organisations-elasticsearch-FAILURE", "brands-FAILURE"}
+	countsBefore := make(map[string]int64)
+	for _, name := range meterNames {
+		countsBefore[name] = metrics.GetOrRegisterMeter(name, metrics.DefaultRegistry).Count()
+	}
+
+	valid := createMessage(uuid, validMessageTypeOrganisations)
+	valid.Body = `{"uuid": "` + uuid + `"}`
+	_, err := ing.processMessage(context.Background(), valid)
+	require.NoError(t, err)
+	invalid := createMessage(otherUUID, validMessageTypeOrganisations)
+	invalid.Body = `{"uuid": `
+	_, err = ing.processMessage(context.Background(), invalid)
+	assert.Error(t, err)
+	_, err = ing.processMessage(context.Background(), createMessage(uuid, "brands"))
+	assert.Error(t, err)
+
+	for _, name := range meterNames {
+		assert.Equal(t, countsBefore[name], metrics.GetOrRegisterMeter(name, metrics.DefaultRegistry).Count(), "Nothing was written in a dry run, so %s should not change", name)
+	}
+}
+
+func TestDryRunReportEndpoint(t *testing.T) {
+	recorder := newDryRunRecorder()
+	recorder.message("organisations")
+	recorder.routingError("brands", resolveErr("brands"))
+	router := adminRouter(&dryRunHandler{recorder: recorder})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/__dry-run", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var report dryRunReport
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, 1, report.Types["organisations"].Messages)
+	assert.Equal(t, 1, report.RoutingErrors["brands"].Count)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("DELETE", "/__dry-run", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, recorder.report().Types, "DELETE should start a new report")
+}
+
+func resolveErr(ingestionType string) error {
+	_, err := resolveWriter(ingestionType, nil)
+	return err
+}
+
+func TestDryRunLeavesTheStoresAndSinksAlone(t *testing.T) {
+	sink := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:      mustRoutingTable(correctWriterMappings, ""),
+		client:      &http.Client{},
+		dryRun:      newDryRunRecorder(),
+		deadLetters: sink,
+		rejections:  sink,
+		dedup:       newDeduplicator(newMemoryDedupStore(time.Hour, 100), false),
+		stale:       newStaleUpdates("Message-Timestamp", false, newMemoryDedupStore(time.Hour, 100)),
+	}
+	msg := publishedAt(createMessage(uuid, validMessageTypeOrganisations), "2016-06-16T08:14:36Z")
+	msg.Body = `{"uuid": "` + uuid + `"}`
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ing.handleMessage(context.Background(), msg))
+	}
+	assert.Equal(t, 2, ing.dryRun.report().Types["organisations"].Messages, "A dry run should not make the real run skip the message as a duplicate")
+	_, recorded, err := ing.stale.store.Get(staleKey(delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid}))
+	require.NoError(t, err)
+	assert.False(t, recorded, "A dry run should not record publish timestamps")
+
+	assert.Error(t, ing.handleMessage(context.Background(), createMessage(uuid, invalidMessageType)), "A failure should not count as dead-lettered")
+	invalid := createMessage(otherUUID, validMessageTypeOrganisations)
+	invalid.Body = `{"uuid": "` + uuid + `"}`
+	assert.NoError(t, ing.handleMessage(context.Background(), invalid), "An invalid concept should count as set aside")
+	assert.Empty(t, sink.deadLetters, "Nothing should be dead-lettered or rejected in a dry run")
+}
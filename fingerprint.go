@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// forceWriteHeader makes the ingester write a concept even if it has not changed.
+const forceWriteHeader = "X-Force-Write"
+
+// contentFingerprints remembers a fingerprint of the concept last written to each destination, so that writes of
+// identical content can be skipped.
+type contentFingerprints struct {
+	store dedupStore
+}
+
+func newContentFingerprints(store dedupStore) *contentFingerprints {
+	return &contentFingerprints{store: store}
+}
+
+func fingerprintKey(d delivery, dest destination) string {
+	return dest.Name + "/" + d.ingestionType + "/" + d.uuid
+}
+
+// fingerprint hashes the body with its keys sorted and insignificant whitespace removed, so that the same concept
+// serialised differently has the same fingerprint. A body that is not JSON is hashed as it is.
+func fingerprint(body string) string {
+	canonical := []byte(body)
+	decoder := json.NewDecoder(bytes.NewReader(canonical))
+	decoder.UseNumber()
+	var concept interface{}
+	if err := decoder.Decode(&concept); err == nil {
+		if encoded, err := json.Marshal(concept); err == nil {
+			canonical = encoded
+		}
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// unchanged reports whether the destination was last sent the same content, in which case the write can be skipped.
+// Deletes and forced writes are never unchanged, and neither is anything when the fingerprints are nil.
+func (f *contentFingerprints) unchanged(d delivery, dest destination) bool {
+	if f == nil || d.deleted || d.force {
+		return false
+	}
+	last, ok, err := f.store.Get(fingerprintKey(d, dest))
+	if err != nil {
+		log.Warnf("Cannot read the fingerprint of %s with uuid: %s for %s: %v", d.ingestionType, d.uuid, dest.Name, err)
+		return false
+	}
+	if !ok || last != fingerprint(d.body) {
+		return false
+	}
+	metrics.GetOrRegisterMeter(dest.meterName(d.ingestionType, "UNCHANGED"), metrics.DefaultRegistry).Mark(1)
+	log.Infof("Skipping unchanged %s with uuid: %s for %s", d.ingestionType, d.uuid, dest.Name)
+	return true
+}
+
+// record remembers the content a destination has after a delivery. After a delete, or a delivery that failed and
+// may or may not have been applied, the content is unknown and the next write is never skipped. Nil fingerprints
+// record nothing.
+func (f *contentFingerprints) record(d delivery, dest destination, err error) {
+	if f == nil {
+		return
+	}
+	value := ""
+	if err == nil && !d.deleted {
+		value = fingerprint(d.body)
+	}
+	if err := f.store.Put(fingerprintKey(d, dest), value); err != nil {
+		log.Warnf("Cannot record the fingerprint of %s with uuid: %s for %s: %v", d.ingestionType, d.uuid, dest.Name, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintIgnoresKeyOrderAndWhitespace(t *testing.T) {
+	assert.Equal(t, fingerprint(`{"uuid": "a", "aliases": ["x", "y"], "year": 1888}`), fingerprint(`{"year":1888,"aliases":["x","y"],"uuid":"a"}`))
+	assert.NotEqual(t, fingerprint(`{"aliases": ["x", "y"]}`), fingerprint(`{"aliases": ["y", "x"]}`))
+	assert.NotEqual(t, fingerprint(`{"year": 1888}`), fingerprint(`{"year": 1888.5}`))
+	assert.Equal(t, fingerprint(`{transformed-org-json`), fingerprint(`{transformed-org-json`))
+}
+
+func TestUnchangedConceptsAreNotWrittenAgain(t *testing.T) {
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.Method]++
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:       mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:       &http.Client{},
+		deletes:      deleteDetector{typeSuffix: "-deleted"},
+		fingerprints: newContentFingerprints(newMemoryDedupStore(time.Hour, 100)),
+	}
+	unchangedCount := getUnchangedCount()
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Body = `{"uuid": "` + uuid + `", "prefLabel": "FT"}`
+	reordered := createMessage(uuid, validMessageTypeOrganisations)
+	reordered.Body = `{"prefLabel":"FT","uuid":"` + uuid + `"}`
+	forced := reordered
+	forced.Headers = map[string]string{"Message-Type": validMessageTypeOrganisations, "Message-Id": uuid, forceWriteHeader: "true"}
+	deleted := createMessage(uuid, "organisations-deleted")
+	deleted.Body = ""
+
+	for i, step := range []struct {
+		msg       queueConsumer.Message
+		unchanged bool
+	}{{msg, false}, {reordered, true}, {forced, false}, {deleted, false}, {msg, false}, {msg, true}} {
+		outcomes, err := ing.processMessage(context.Background(), step.msg)
+		require.NoError(t, err)
+		require.Len(t, outcomes, 1)
+		assert.Equal(t, step.unchanged, outcomes[0].Unchanged, "Message %d", i)
+	}
+	assert.Equal(t, map[string]int{"PUT": 3, "DELETE": 1}, calls)
+	assert.Equal(t, int64(2), getUnchangedCount()-unchangedCount)
+}
+
+func TestFailedWritesAreNotRemembered(t *testing.T) {
+	status := http.StatusOK
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:       mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:       &http.Client{},
+		fingerprints: newContentFingerprints(newMemoryDedupStore(time.Hour, 100)),
+	}
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+
+	_, err := ing.processMessage(context.Background(), msg)
+	require.NoError(t, err)
+	status = http.StatusBadRequest
+	changed := msg
+	changed.Body = `{"uuid": "` + uuid + `"}`
+	_, err = ing.processMessage(context.Background(), changed)
+	require.Error(t, err)
+	status = http.StatusOK
+	_, err = ing.processMessage(context.Background(), msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, calls, "The content of a destination is unknown after a failed write")
+}
+
+func getUnchangedCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-UNCHANGED", metrics.DefaultRegistry).Count()
+}
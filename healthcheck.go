@@ -1,20 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
 
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
-	"github.com/Financial-Times/message-queue-gonsumer/consumer"
 	"github.com/Financial-Times/service-status-go/gtg"
 )
 
+// writerCheckTimeout bounds the gtg calls to the writers, so that a writer that never answers fails its check.
+const writerCheckTimeout = 5 * time.Second
+
 type HealthCheck struct {
 	baseURLs          []string
 	elasticsearchConf *ElasticsearchWriterConfig
-	consumer          consumer.MessageConsumer
+	consumer          messageSource
 	client            *http.Client
+	// additionalChecks are shown on the health page after the connectivity checks
+	additionalChecks []fthealth.Check
 }
 
 type ElasticsearchWriterConfig struct {
@@ -22,7 +27,7 @@ type ElasticsearchWriterConfig struct {
 	includeElasticsearchWriter bool
 }
 
-func NewHealthCheck(c consumer.MessageConsumer, baseURLs []string, elasticsearchConf *ElasticsearchWriterConfig, client *http.Client) *HealthCheck {
+func NewHealthCheck(c messageSource, baseURLs []string, elasticsearchConf *ElasticsearchWriterConfig, client *http.Client) *HealthCheck {
 	return &HealthCheck{
 		consumer:          c,
 		baseURLs:          baseURLs,
@@ -36,6 +41,7 @@ func (h *HealthCheck) Health() func(w http.ResponseWriter, r *http.Request) {
 	if h.elasticsearchConf.includeElasticsearchWriter {
 		checks = append(checks, h.elasticHealthCheck())
 	}
+	checks = append(checks, h.additionalChecks...)
 	healthCheck := fthealth.TimedHealthCheck{
 		HealthCheck: fthealth.HealthCheck{
 			SystemCode:  "concept-ingester",
@@ -104,7 +110,7 @@ func (h *HealthCheck) GTG() gtg.Status {
 }
 
 func (h *HealthCheck) checkCanConnectToWriters() (string, error) {
-	err := h.checkWritersAvailability()
+	err := h.checkWritersWithTimeout()
 	if err != nil {
 		return fmt.Sprintf("Healthcheck: Writer not available: %v", err.Error()), err
 	}
@@ -112,16 +118,25 @@ func (h *HealthCheck) checkCanConnectToWriters() (string, error) {
 }
 
 func (h *HealthCheck) checkCanConnectToElasticsearchWriter() (string, error) {
-	err := h.checkWriterAvailability(h.elasticsearchConf.elasticsearchWriterUrl)
+	ctx, cancel := context.WithTimeout(context.Background(), writerCheckTimeout)
+	defer cancel()
+	err := h.checkWriterAvailability(ctx, h.elasticsearchConf.elasticsearchWriterUrl)
 	if err != nil {
 		return fmt.Sprintf("Healthcheck: Elasticsearch Concept Writer not available: %v", err.Error()), err
 	}
 	return "", nil
 }
 
-func (h *HealthCheck) checkWritersAvailability() error {
+// checkWritersWithTimeout checks the writers, giving up on any that have not answered within writerCheckTimeout.
+func (h *HealthCheck) checkWritersWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), writerCheckTimeout)
+	defer cancel()
+	return h.checkWritersAvailability(ctx)
+}
+
+func (h *HealthCheck) checkWritersAvailability(ctx context.Context) error {
 	for _, baseURL := range h.baseURLs {
-		err := h.checkWriterAvailability(baseURL)
+		err := h.checkWriterAvailability(ctx, baseURL)
 		if err != nil {
 			return err
 		}
@@ -129,8 +144,12 @@ func (h *HealthCheck) checkWritersAvailability() error {
 	return nil
 }
 
-func (h *HealthCheck) checkWriterAvailability(baseURL string) error {
-	resp, err := h.client.Get(baseURL + "/__gtg")
+func (h *HealthCheck) checkWriterAvailability(ctx context.Context, baseURL string) error {
+	request, err := http.NewRequest("GET", baseURL+"/__gtg", nil)
+	if err != nil {
+		return fmt.Errorf("Error calling writer at %s : %v", baseURL+"/__gtg", err)
+	}
+	resp, err := h.client.Do(request.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("Error calling writer at %s : %v", baseURL+"/__gtg", err)
 	}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/Financial-Times/message-queue-gonsumer/consumer"
 	"github.com/stretchr/testify/assert"
@@ -404,6 +406,18 @@ func getFullURLs(endpoints []endpoint, baseURL string) []string {
 	return URLs
 }
 
+func TestHangingWriterFailsItsCheck(t *testing.T) {
+	server, _ := hangingWriter()
+	defer server.Close()
+	hc := initHealthCheckWithoutElasticsearchWriter(true, []string{server.URL})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := hc.checkWritersAvailability(ctx)
+
+	assert.Error(t, err, "A writer that does not answer its gtg in time should be unavailable")
+}
+
 func initHealthCheckWithElasticsearchWriter(isConsumerConnectionHealthy bool, baseURLs []string, elasticsearchWriterUrl string) *HealthCheck {
 	return &HealthCheck{
 		consumer: &mockConsumerInstance{isConnectionHealthy: isConsumerConnectionHealthy},
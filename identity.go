@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// uuidPolicy decides which UUID a concept is written under when its Message-Id header and the uuid in its body
+// disagree.
+type uuidPolicy string
+
+const (
+	// rejectMismatch rejects concepts whose header and body UUIDs disagree
+	rejectMismatch uuidPolicy = "reject"
+	// preferBody writes concepts under the UUID in their body
+	preferBody uuidPolicy = "body"
+	// preferHeader writes concepts under their Message-Id, as the ingester always used to
+	preferHeader uuidPolicy = "header"
+)
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func parseUUIDPolicy(policy string) (uuidPolicy, error) {
+	switch p := uuidPolicy(policy); p {
+	case rejectMismatch, preferBody, preferHeader:
+		return p, nil
+	case "":
+		return rejectMismatch, nil
+	}
+	return "", fmt.Errorf("Unknown UUID mismatch policy: %s", policy)
+}
+
+// resolve returns the UUID to write the concept under, from its Message-Id header and the uuid field of its body.
+// When only one of them is set that one is used, and when they disagree the policy decides. The UUID must be a
+// valid UUID, otherwise a validationError is returned so that the concept is rejected before any writer is called.
+func (p uuidPolicy) resolve(ingestionType string, headerUUID string, body string) (string, error) {
+	bodyUUID := bodyUUID(body)
+	resolved := headerUUID
+	switch {
+	case headerUUID == "":
+		resolved = bodyUUID
+	case bodyUUID == "" || strings.EqualFold(bodyUUID, headerUUID):
+	case p == preferBody:
+		resolved = bodyUUID
+	case p == preferHeader:
+	default:
+		return "", &validationError{ingestionType: ingestionType, uuid: headerUUID,
+			errors: []string{fmt.Sprintf("Message-Id %s does not match uuid %s in the body", headerUUID, bodyUUID)}}
+	}
+	if resolved == "" {
+		return "", &validationError{ingestionType: ingestionType, errors: []string{"No Message-Id header or uuid in the body"}}
+	}
+	if !uuidRegex.MatchString(resolved) {
+		return "", &validationError{ingestionType: ingestionType, uuid: resolved, errors: []string{fmt.Sprintf("%q is not a UUID", resolved)}}
+	}
+	return resolved, nil
+}
+
+// bodyUUID returns the uuid field of a concept, or "" if the body is not a JSON object with a string uuid.
+func bodyUUID(body string) string {
+	var concept struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal([]byte(body), &concept); err != nil {
+		return ""
+	}
+	return concept.UUID
+}
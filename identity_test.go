@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUIDResolution(t *testing.T) {
+	body := `{"uuid": "` + otherUUID + `"}`
+	tests := []struct {
+		name     string
+		policy   uuidPolicy
+		header   string
+		body     string
+		expected string
+	}{
+		{"matching", rejectMismatch, uuid, `{"uuid": "` + uuid + `"}`, uuid},
+		{"matching in a different case", rejectMismatch, uuid, `{"uuid": "` + strings.ToUpper(uuid) + `"}`, uuid},
+		{"body without uuid", rejectMismatch, uuid, `{}`, uuid},
+		{"body that is not JSON", rejectMismatch, uuid, `{transformed-org-json`, uuid},
+		{"no header", rejectMismatch, "", body, otherUUID},
+		{"prefer body", preferBody, uuid, body, otherUUID},
+		{"prefer header", preferHeader, uuid, body, uuid},
+	}
+	for _, test := range tests {
+		resolved, err := test.policy.resolve("organisations", test.header, test.body)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, resolved, test.name)
+	}
+}
+
+func TestInvalidUUIDsAreRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy uuidPolicy
+		header string
+		body   string
+	}{
+		{"mismatch", rejectMismatch, uuid, `{"uuid": "` + otherUUID + `"}`},
+		{"no uuid", preferBody, "", `{}`},
+		{"header that is not a UUID", preferHeader, "not-a-uuid", `{}`},
+		{"body that is not a UUID", preferBody, uuid, `{"uuid": "../organisations"}`},
+	}
+	for _, test := range tests {
+		_, err := test.policy.resolve("organisations", test.header, test.body)
+		assert.IsType(t, &validationError{}, err, test.name)
+	}
+}
+
+func TestParseUUIDPolicy(t *testing.T) {
+	policy, err := parseUUIDPolicy("body")
+	require.NoError(t, err)
+	assert.Equal(t, preferBody, policy)
+
+	_, err = parseUUIDPolicy("both")
+	assert.Error(t, err)
+}
+
+func TestConceptIsWrittenUnderTheResolvedUUID(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer server.Close()
+
+	rejections := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:     mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:     &http.Client{},
+		rejections: rejections,
+		uuids:      preferBody,
+	}
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Body = `{"uuid": "` + otherUUID + `"}`
+	require.NoError(t, ing.handleMessage(context.Background(), msg))
+	assert.Equal(t, "/organisations/"+otherUUID, path)
+
+	path = ""
+	msg = createMessage("", validMessageTypeOrganisations)
+	msg.Body = `{}`
+	require.NoError(t, ing.handleMessage(context.Background(), msg))
+	assert.Empty(t, path, "A concept without a UUID should not be sent to the writers")
+	assert.Len(t, rejections.deadLetters, 1)
+}
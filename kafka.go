@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafkaConsumer reads from the Kafka brokers directly as a member of a consumer group, instead of going through the
+// kafka-rest-proxy. Kafka assigns the topic's partitions to the members of the group. The messages of a partition
+// are handled in order, and a message's offset is only committed once the handler has returned nil for it. When the
+// handler fails, the consumer leaves the session and joins again, carrying on from the failed message.
+type kafkaConsumer struct {
+	topic   string
+	client  sarama.Client
+	group   sarama.ConsumerGroup
+	handler func(msg queueConsumer.Message) error
+	backoff time.Duration
+
+	cancel  context.CancelFunc
+	ctx     context.Context
+	stopped chan struct{}
+}
+
+// newKafkaConfig returns the sarama configuration for a consumer group member. offset is "smallest" to start a new
+// group from the oldest message, as for the kafka-rest-proxy, and anything else to start from the newest.
+func newKafkaConfig(version string, offset string) (*sarama.Config, error) {
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Kafka version %q: %v", version, err)
+	}
+	config := sarama.NewConfig()
+	config.ClientID = "concept-ingester"
+	config.Version = kafkaVersion
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if offset == "smallest" {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	return config, nil
+}
+
+func newKafkaConsumer(brokers []string, groupID string, topic string, config *sarama.Config, handler func(msg queueConsumer.Message) error, backoff time.Duration) (*kafkaConsumer, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to Kafka brokers %v: %v", brokers, err)
+	}
+	group, err := sarama.NewConsumerGroupFromClient(groupID, client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Cannot join consumer group %s: %v", groupID, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaConsumer{
+		topic:   topic,
+		client:  client,
+		group:   group,
+		handler: handler,
+		backoff: backoff,
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// Start consumes until Stop is called. Messages being handled when Stop is called are finished first.
+func (c *kafkaConsumer) Start() {
+	defer close(c.stopped)
+	for {
+		// Consume returns when the session ends, because of a rebalance, a failed message or Stop
+		if err := c.group.Consume(c.ctx, []string{c.topic}, c); err != nil {
+			log.Errorf("Error consuming from topic %s: %v", c.topic, err)
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.backoff):
+		}
+	}
+}
+
+func (c *kafkaConsumer) Stop() {
+	c.cancel()
+	<-c.stopped
+	if err := c.group.Close(); err != nil {
+		log.Warnf("Cannot leave consumer group cleanly: %v", err)
+	}
+	c.client.Close()
+}
+
+func (c *kafkaConsumer) ConnectivityCheck() (string, error) {
+	if err := c.client.RefreshMetadata(c.topic); err != nil {
+		return "Error connecting to Kafka", err
+	}
+	return "", nil
+}
+
+func (c *kafkaConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	log.Infof("Consuming partitions %v of topic %s as member %s", session.Claims()[c.topic], c.topic, session.MemberID())
+	return nil
+}
+
+func (c *kafkaConsumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim handles the messages of one partition in order. It returns, ending the session, when a message is
+// neither delivered nor dead-lettered, so that its offset and those after it are not committed.
+func (c *kafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case record, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			msg, err := decodeFTMessage(record.Value)
+			if err != nil {
+				log.Errorf("Skipping message at partition %d offset %d: %v", record.Partition, record.Offset, err)
+				session.MarkMessage(record, "")
+				continue
+			}
+			if err := c.handler(msg); err != nil {
+				metrics.GetOrRegisterMeter("consumer-UNCOMMITTED", metrics.DefaultRegistry).Mark(1)
+				log.Warnf("Not committing partition %d from offset %d, the message could not be delivered or dead-lettered; it will be consumed again", record.Partition, record.Offset)
+				return err
+			}
+			session.MarkMessage(record, "")
+		}
+	}
+}
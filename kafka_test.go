@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	kafkaTestTopic = "Concept"
+	kafkaTestGroup = "TestConcepts"
+)
+
+// fakeKafka is an in-process broker that is the coordinator of a consumer group with a single member, which is
+// assigned the only partition of the topic.
+type fakeKafka struct {
+	t      *testing.T
+	broker *sarama.MockBroker
+	fetch  *sarama.MockFetchResponse
+
+	mu       sync.Mutex
+	handlers map[string]sarama.MockResponse
+}
+
+func newFakeKafka(t *testing.T, uuids ...string) *fakeKafka {
+	k := &fakeKafka{t: t, broker: sarama.NewMockBroker(t, 1), fetch: sarama.NewMockFetchResponse(t, 1).SetVersion(3)}
+	for i, id := range uuids {
+		msg := createMessage(id, validMessageTypeOrganisations)
+		k.fetch.SetMessage(kafkaTestTopic, 0, int64(i), sarama.ByteEncoder(encodeFTMessage(msg.Headers, msg.Body)))
+	}
+	k.fetch.SetHighWaterMark(kafkaTestTopic, 0, int64(len(uuids)))
+
+	k.handlers = map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(k.broker.Addr(), k.broker.BrokerID()).
+			SetLeader(kafkaTestTopic, 0, k.broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, kafkaTestGroup, k.broker),
+		"JoinGroupRequest": sarama.NewMockWrapper(&sarama.JoinGroupResponse{
+			Version: 1, GenerationId: 1, GroupProtocol: "range", LeaderId: "another-member", MemberId: "member-1"}),
+		"SyncGroupRequest":  sarama.NewMockWrapper(&sarama.SyncGroupResponse{MemberAssignment: memberAssignment(kafkaTestTopic, 0)}),
+		"HeartbeatRequest":  sarama.NewMockWrapper(&sarama.HeartbeatResponse{}),
+		"LeaveGroupRequest": sarama.NewMockWrapper(&sarama.LeaveGroupResponse{}),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset(kafkaTestTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(kafkaTestTopic, 0, sarama.OffsetNewest, int64(len(uuids))),
+		"FetchRequest":        k.fetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	}
+	k.setCommittedOffset(-1)
+	return k
+}
+
+// setCommittedOffset sets the offset the group resumes from when it joins.
+func (k *fakeKafka) setCommittedOffset(offset int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.handlers["OffsetFetchRequest"] = sarama.NewMockOffsetFetchResponse(k.t).
+		SetOffset(kafkaTestGroup, kafkaTestTopic, 0, offset, "", sarama.ErrNoError)
+	k.broker.SetHandlerByMap(k.handlers)
+}
+
+// committedOffset returns the highest offset committed by the group, or -1 if none was.
+func (k *fakeKafka) committedOffset() int64 {
+	committed := int64(-1)
+	for _, rr := range k.broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := req.Offset(kafkaTestTopic, 0); err == nil && offset > committed {
+				committed = offset
+			}
+		}
+	}
+	return committed
+}
+
+// memberAssignment encodes the assignment of the given partitions of a topic in the consumer protocol format.
+func memberAssignment(topic string, partitions ...int32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, int16(0))
+	binary.Write(&b, binary.BigEndian, int32(1))
+	binary.Write(&b, binary.BigEndian, int16(len(topic)))
+	b.WriteString(topic)
+	binary.Write(&b, binary.BigEndian, int32(len(partitions)))
+	for _, p := range partitions {
+		binary.Write(&b, binary.BigEndian, p)
+	}
+	binary.Write(&b, binary.BigEndian, int32(-1))
+	return b.Bytes()
+}
+
+func newTestKafkaConsumer(t *testing.T, k *fakeKafka, handler func(msg queueConsumer.Message) error) *kafkaConsumer {
+	config, err := newKafkaConfig("0.10.2.0", "smallest")
+	require.NoError(t, err)
+	config.Consumer.Offsets.CommitInterval = 10 * time.Millisecond
+	config.Metadata.Retry.Backoff = time.Millisecond
+	c, err := newKafkaConsumer([]string{k.broker.Addr()}, kafkaTestGroup, kafkaTestTopic, config, handler, time.Millisecond)
+	require.NoError(t, err)
+	return c
+}
+
+func TestKafkaConsumerCommitsHandledMessages(t *testing.T) {
+	k := newFakeKafka(t, conceptUUID(0), conceptUUID(1), conceptUUID(2))
+	defer k.broker.Close()
+
+	handled := &handledMessages{}
+	c := newTestKafkaConsumer(t, k, func(msg queueConsumer.Message) error {
+		handled.record(msg)
+		return nil
+	})
+	go c.Start()
+	waitFor(t, func() bool { return k.committedOffset() == 3 }, "Every message should have been committed")
+
+	_, err := c.ConnectivityCheck()
+	assert.NoError(t, err)
+	c.Stop()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 1, handled.count(conceptUUID(i)))
+	}
+}
+
+func TestKafkaConsumerDoesNotCommitPastAFailedMessage(t *testing.T) {
+	k := newFakeKafka(t, conceptUUID(0), conceptUUID(1), conceptUUID(2))
+	defer k.broker.Close()
+
+	handled := &handledMessages{}
+	var committedBeforeRetry int64
+	c := newTestKafkaConsumer(t, k, func(msg queueConsumer.Message) error {
+		count := handled.record(msg)
+		if msg.Headers["Message-Id"] != conceptUUID(1) {
+			return nil
+		}
+		if count == 1 {
+			// like a real broker, the group carries on from the last commit when it joins again
+			k.setCommittedOffset(1)
+			return errors.New("writer unavailable")
+		}
+		committedBeforeRetry = k.committedOffset()
+		return nil
+	})
+	go c.Start()
+	waitFor(t, func() bool { return k.committedOffset() == 3 }, "Every message should be committed once the failed one succeeds")
+	c.Stop()
+
+	assert.Equal(t, 1, handled.count(conceptUUID(0)), "Committed messages should not be consumed again")
+	assert.Equal(t, 2, handled.count(conceptUUID(1)), "The failed message should have been consumed again")
+	assert.Equal(t, 1, handled.count(conceptUUID(2)), "Messages after the failed one should wait for it")
+	assert.True(t, committedBeforeRetry <= 1, "Nothing from the failed message on should be committed until it succeeds")
+}
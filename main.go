@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,13 +12,14 @@ import (
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
 	"github.com/Financial-Times/http-handlers-go/httphandlers"
 	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
 	status "github.com/Financial-Times/service-status-go/httphandlers"
+	"github.com/Shopify/sarama"
 	"github.com/cyberdelia/go-metrics-graphite"
 	"github.com/gorilla/mux"
 	"github.com/jawher/mow.cli"
@@ -34,6 +37,60 @@ func main() {
 		Desc:   "neo4j writer services",
 		EnvVar: "SERVICES",
 	})
+	routes := app.String(cli.StringOpt{
+		Name:   "routes",
+		Value:  "",
+		Desc:   "Comma separated rule=writer routes that add to or override the message types derived from the writer names. A rule is a message type, glob:<pattern>, regex:<expression> or default, e.g. special-people=special-people-rw-neo4j,glob:*-series=series-rw-neo4j",
+		EnvVar: "ROUTES",
+	})
+	routingConfigFile := app.String(cli.StringOpt{
+		Name:   "routing-config",
+		Value:  "",
+		Desc:   "JSON file that routes each message type to a list of destinations, each with its own URL template, method and whether it is required. Replaces the services list, routes and elasticsearch writer when set.",
+		EnvVar: "ROUTING_CONFIG",
+	})
+	deliveryMode := app.String(cli.StringOpt{
+		Name:   "delivery-mode",
+		Value:  "sequential",
+		Desc:   "'sequential' delivers a concept to one destination after another, stopping at the first required failure. 'parallel' delivers to all destinations concurrently, except that a destination waits for the destinations listed in its 'after'.",
+		EnvVar: "DELIVERY_MODE",
+	})
+	elasticsearchAfterNeo4j := app.Bool(cli.BoolOpt{
+		Name:   "elasticsearch-after-neo4j",
+		Value:  true,
+		Desc:   "In parallel delivery mode, only write to the elasticsearch writer once the neo4j writer has succeeded",
+		EnvVar: "ELASTICSEARCH_AFTER_NEO4J",
+	})
+	bulkSize := app.Int(cli.IntOpt{
+		Name:   "bulk-size",
+		Value:  1,
+		Desc:   "Maximum number of concepts of a type sent in one request to a bulk endpoint, such as the elasticsearch writer's. 1 or less (default) sends every concept on its own. Each concept waits for its batch to fill or for bulk-flush-interval-ms, so only batch when many concepts are delivered at once.",
+		EnvVar: "BULK_SIZE",
+	})
+	bulkFlushInterval := app.Int(cli.IntOpt{
+		Name:   "bulk-flush-interval-ms",
+		Value:  500,
+		Desc:   "Maximum time in milliseconds a concept waits for its bulk request to fill up before it is sent",
+		EnvVar: "BULK_FLUSH_INTERVAL_MS",
+	})
+	deleteTypeSuffix := app.String(cli.StringOpt{
+		Name:   "delete-type-suffix",
+		Value:  "-deleted",
+		Desc:   "Message-Type suffix that marks a concept deletion, e.g. organisations-deleted deletes an organisation. Leave empty to disable.",
+		EnvVar: "DELETE_TYPE_SUFFIX",
+	})
+	deleteOnEmptyBody := app.Bool(cli.BoolOpt{
+		Name:   "delete-on-empty-body",
+		Value:  false,
+		Desc:   "Treat a message with an empty body as a concept deletion. Off by default, so that a message whose body was lost is not mistaken for a deletion.",
+		EnvVar: "DELETE_ON_EMPTY_BODY",
+	})
+	deleteMarker := app.String(cli.StringOpt{
+		Name:   "delete-marker",
+		Value:  "",
+		Desc:   "field=value that marks a concept deletion when a top-level field of the JSON body has that value, e.g. deleted=true",
+		EnvVar: "DELETE_MARKER",
+	})
 	elasticService := app.String(cli.StringOpt{
 		Name:   "elastic-service",
 		Desc:   "elasticsearch writer service",
@@ -96,11 +153,266 @@ func main() {
 		Value:  "kafka-topic",
 		Desc:   "Kafka topic subscribed to",
 		EnvVar: "TOPIC"})
+	source := app.String(cli.StringOpt{
+		Name:   "source",
+		Value:  "proxy",
+		Desc:   "Where messages are consumed from: 'proxy' reads through the kafka-rest-proxy at vulcan_addr, 'kafka' reads from the Kafka brokers directly",
+		EnvVar: "SOURCE"})
+	kafkaBrokers := app.String(cli.StringOpt{
+		Name:   "kafka-brokers",
+		Value:  "",
+		Desc:   "Comma separated Kafka broker addresses used by the kafka source, e.g. kafka-1:9092,kafka-2:9092",
+		EnvVar: "KAFKA_BROKERS"})
+	kafkaVersion := app.String(cli.StringOpt{
+		Name:   "kafka-version",
+		Value:  "1.0.0",
+		Desc:   "Version of the Kafka brokers used by the kafka source",
+		EnvVar: "KAFKA_VERSION"})
+	input := app.String(cli.StringOpt{
+		Name:   "input",
+		Value:  "",
+		Desc:   "Comma separated NDJSON files or directories of them to ingest instead of consuming from Kafka, '-' for stdin. Each line is a message like {\"headers\": {\"Message-Type\": ..., \"Message-Id\": ...}, \"body\": ...}. The ingester exits with a summary once they are all processed.",
+		EnvVar: "INPUT"})
+	inputWorkers := app.Int(cli.IntOpt{
+		Name:   "input-workers",
+		Value:  4,
+		Desc:   "Number of messages from --input processed at once",
+		EnvVar: "INPUT_WORKERS"})
+	dryRun := app.Bool(cli.BoolOpt{
+		Name:   "dry-run",
+		Value:  false,
+		Desc:   "Route the messages and build and validate their requests without sending them to the writers or dead-lettering them. What would have been sent is reported on /__dry-run, or in the summary with --input.",
+		EnvVar: "DRY_RUN"})
+	dedupTTL := app.Int(cli.IntOpt{
+		Name:   "dedup-ttl-ms",
+		Value:  0,
+		Desc:   "How long in milliseconds a delivered message is remembered, so that redeliveries of it are skipped, 0 to not skip duplicates",
+		EnvVar: "DEDUP_TTL_MS"})
+	dedupCapacity := app.Int(cli.IntOpt{
+		Name:   "dedup-capacity",
+		Value:  100000,
+		Desc:   "Maximum number of delivered messages remembered for deduplication",
+		EnvVar: "DEDUP_CAPACITY"})
+	dedupBody := app.Bool(cli.BoolOpt{
+		Name:   "dedup-body",
+		Value:  true,
+		Desc:   "Only treat a message as a duplicate if its body is the same too, rather than just its type and Message-Id",
+		EnvVar: "DEDUP_BODY"})
+	unchangedTTL := app.Int(cli.IntOpt{
+		Name:   "unchanged-ttl-ms",
+		Value:  0,
+		Desc:   "How long in milliseconds the content written to a destination is remembered, so that writes of the same content are skipped. 0 (default) sends every write.",
+		EnvVar: "UNCHANGED_TTL_MS"})
+	unchangedCapacity := app.Int(cli.IntOpt{
+		Name:   "unchanged-capacity",
+		Value:  200000,
+		Desc:   "Maximum number of fingerprints remembered, one for each concept and destination, shared by all destinations. Each takes about 300 bytes of memory.",
+		EnvVar: "UNCHANGED_CAPACITY"})
+	forceWrites := app.Bool(cli.BoolOpt{
+		Name:   "force-writes",
+		Value:  false,
+		Desc:   "Send every write even if the destination already has the same content. A message can also force its writes with an X-Force-Write: true header.",
+		EnvVar: "FORCE_WRITES"})
+	staleMode := app.String(cli.StringOpt{
+		Name:   "stale-updates",
+		Value:  "allow",
+		Desc:   "What to do with a message published before the last message applied to its concept: 'drop' it, 'dead-letter' it or 'allow' (default) it to overwrite the newer concept. Only 'drop' and 'dead-letter' remember publish times.",
+		EnvVar: "STALE_UPDATES"})
+	timestampHeader := app.String(cli.StringOpt{
+		Name:   "timestamp-header",
+		Value:  "Message-Timestamp",
+		Desc:   "Header holding the RFC3339 time a message was published",
+		EnvVar: "TIMESTAMP_HEADER"})
+	staleTTL := app.Int(cli.IntOpt{
+		Name:   "stale-ttl-ms",
+		Value:  86400000,
+		Desc:   "How long in milliseconds the publish time of the last message applied to a concept is remembered",
+		EnvVar: "STALE_TTL_MS"})
+	staleCapacity := app.Int(cli.IntOpt{
+		Name:   "stale-capacity",
+		Value:  200000,
+		Desc:   "Maximum number of concepts whose last publish time is remembered. Each takes about 250 bytes of memory.",
+		EnvVar: "STALE_CAPACITY"})
+	uuidMismatch := app.String(cli.StringOpt{
+		Name:   "uuid-mismatch",
+		Value:  "reject",
+		Desc:   "What to do with a concept whose Message-Id header and uuid field disagree: 'reject' it, write it under the uuid in the 'body' or under the Message-Id in the 'header'",
+		EnvVar: "UUID_MISMATCH"})
+	schemaDir := app.String(cli.StringOpt{
+		Name:   "schema-dir",
+		Value:  "",
+		Desc:   "Directory of JSON Schemas, one <type>.json per message type, that concepts are validated against before they are routed. Leave empty to not validate.",
+		EnvVar: "SCHEMA_DIR"})
+	rejectionSinkType := app.String(cli.StringOpt{
+		Name:   "rejection-sink",
+		Value:  "",
+		Desc:   "Where to send concepts that failed validation: 'kafka' publishes them to the rejection topic through the kafka proxy, 'file' appends them to the rejection file. Leave empty to only log them.",
+		EnvVar: "REJECTION_SINK"})
+	rejectionTopic := app.String(cli.StringOpt{
+		Name:   "rejection-topic",
+		Value:  "ConceptIngesterRejections",
+		Desc:   "Kafka topic that rejected concepts are published to",
+		EnvVar: "REJECTION_TOPIC"})
+	rejectionFile := app.String(cli.StringOpt{
+		Name:   "rejection-file",
+		Value:  "rejections.ndjson",
+		Desc:   "File that rejected concepts are appended to",
+		EnvVar: "REJECTION_FILE"})
 	throttle := app.Int(cli.IntOpt{
 		Name:   "throttle",
 		Value:  1000,
-		Desc:   "Throttle",
+		Desc:   "Maximum messages per second for each message type, 0 for unlimited",
 		EnvVar: "THROTTLE"})
+	throttleBurst := app.Int(cli.IntOpt{
+		Name:   "throttle-burst",
+		Value:  1,
+		Desc:   "Number of messages of a type that can be processed at once before --throttle applies",
+		EnvVar: "THROTTLE_BURST"})
+	writerThrottle := app.Int(cli.IntOpt{
+		Name:   "writer-throttle",
+		Value:  0,
+		Desc:   "Maximum concepts per second sent to each writer, 0 for unlimited",
+		EnvVar: "WRITER_THROTTLE"})
+	writerThrottleBurst := app.Int(cli.IntOpt{
+		Name:   "writer-throttle-burst",
+		Value:  1,
+		Desc:   "Number of concepts that can be sent to a writer at once before --writer-throttle applies",
+		EnvVar: "WRITER_THROTTLE_BURST"})
+	rateLimits := app.String(cli.StringOpt{
+		Name:   "rate-limits",
+		Value:  "",
+		Desc:   "Comma separated key=rate/burst limits that override the throttles for a message type or writer, e.g. type:organisations=100/20,writer:http://people-rw-neo4j:8080=50/5",
+		EnvVar: "RATE_LIMITS"})
+	adaptiveThrottling := app.Bool(cli.BoolOpt{
+		Name:   "adaptive-throttle",
+		Value:  false,
+		Desc:   "Adjust the rate of each writer automatically, halving it when the writer is slow or failing and ramping it back up when it recovers",
+		EnvVar: "ADAPTIVE_THROTTLE"})
+	adaptiveMinRate := app.Int(cli.IntOpt{
+		Name:   "adaptive-min-rate",
+		Value:  1,
+		Desc:   "Lowest rate in concepts per second that adaptive throttling reduces a writer to",
+		EnvVar: "ADAPTIVE_MIN_RATE"})
+	adaptiveMaxRate := app.Int(cli.IntOpt{
+		Name:   "adaptive-max-rate",
+		Value:  100,
+		Desc:   "Highest rate in concepts per second that adaptive throttling allows a writer. An unlimited writer is cut to half of it when it first struggles.",
+		EnvVar: "ADAPTIVE_MAX_RATE"})
+	adaptiveLatencyThreshold := app.Int(cli.IntOpt{
+		Name:   "adaptive-latency-threshold-ms",
+		Value:  1000,
+		Desc:   "Average writer response time in milliseconds above which adaptive throttling reduces the writer's rate",
+		EnvVar: "ADAPTIVE_LATENCY_THRESHOLD_MS"})
+	adaptiveErrorThreshold := app.Int(cli.IntOpt{
+		Name:   "adaptive-error-threshold-percent",
+		Value:  10,
+		Desc:   "Percentage of writer calls failing with a connection error, 429 or 5xx above which adaptive throttling reduces the writer's rate",
+		EnvVar: "ADAPTIVE_ERROR_THRESHOLD_PERCENT"})
+	adaptiveInterval := app.Int(cli.IntOpt{
+		Name:   "adaptive-interval-ms",
+		Value:  5000,
+		Desc:   "How often in milliseconds adaptive throttling adjusts the writer rates",
+		EnvVar: "ADAPTIVE_INTERVAL_MS"})
+	breakerFailureThreshold := app.Int(cli.IntOpt{
+		Name:   "breaker-failure-threshold",
+		Value:  5,
+		Desc:   "Consecutive connection errors, 429s or 5xxs from a writer that open its circuit breaker, 0 to disable circuit breakers",
+		EnvVar: "BREAKER_FAILURE_THRESHOLD"})
+	breakerOpenTimeout := app.Int(cli.IntOpt{
+		Name:   "breaker-open-timeout-ms",
+		Value:  30000,
+		Desc:   "How long in milliseconds an open circuit breaker stops a writer being called before one call is let through to test it",
+		EnvVar: "BREAKER_OPEN_TIMEOUT_MS"})
+	breakerMode := app.String(cli.StringOpt{
+		Name:   "breaker-mode",
+		Value:  "fail",
+		Desc:   "What happens to a concept for a writer whose circuit breaker is open: 'fail' fails it straight away, 'park' holds it until the writer can be tried again",
+		EnvVar: "BREAKER_MODE"})
+	shutdownGracePeriod := app.Int(cli.IntOpt{
+		Name:   "shutdown-grace-period-ms",
+		Value:  25000,
+		Desc:   "How long in milliseconds to wait on shutdown for messages being processed to finish. Keep it below the pod's termination grace period.",
+		EnvVar: "SHUTDOWN_GRACE_PERIOD_MS"})
+	coalesceWindows := app.String(cli.StringOpt{
+		Name:   "coalesce-windows",
+		Value:  "",
+		Desc:   "Comma separated type=milliseconds windows, e.g. organisations=2000. The messages of those types are held back for the window and only the latest message for each concept is delivered. Cannot be used with manual-commit.",
+		EnvVar: "COALESCE_WINDOWS"})
+	orderingWorkers := app.Int(cli.IntOpt{
+		Name:   "ordering-workers",
+		Value:  0,
+		Desc:   "Number of workers handling messages from the kafka proxy. The messages for a concept always go to the same worker, so they are handled in order. 0 handles messages as they arrive, in any order.",
+		EnvVar: "ORDERING_WORKERS"})
+	orderingQueueSize := app.Int(cli.IntOpt{
+		Name:   "ordering-queue-size",
+		Value:  100,
+		Desc:   "Number of messages that can wait for each ordering worker before consumption is held up",
+		EnvVar: "ORDERING_QUEUE_SIZE"})
+	manualCommit := app.Bool(cli.BoolOpt{
+		Name:   "manual-commit",
+		Value:  false,
+		Desc:   "Only commit the offsets of a batch once every message in it has been delivered to its required destinations or dead-lettered. Replaces consumer_autocommit_enable.",
+		EnvVar: "MANUAL_COMMIT"})
+	pauseOnUnhealthyWriters := app.Bool(cli.BoolOpt{
+		Name:   "pause-on-unhealthy-writers",
+		Value:  false,
+		Desc:   "Stop consuming while any required writer fails its gtg, and resume once they all pass again",
+		EnvVar: "PAUSE_ON_UNHEALTHY_WRITERS"})
+	writerHealthInterval := app.Int(cli.IntOpt{
+		Name:   "writer-health-interval-ms",
+		Value:  5000,
+		Desc:   "How often in milliseconds the writers' gtg is checked when pausing on unhealthy writers",
+		EnvVar: "WRITER_HEALTH_INTERVAL_MS"})
+	writerMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "writer-max-attempts",
+		Value:  3,
+		Desc:   "Maximum number of attempts to send a concept to a writer. Only connection errors, 429 and 5xx responses are retried.",
+		EnvVar: "WRITER_MAX_ATTEMPTS"})
+	writerTimeout := app.Int(cli.IntOpt{
+		Name:   "writer-timeout-ms",
+		Value:  60000,
+		Desc:   "Default time in milliseconds allowed for delivering a concept to a writer, retries included, 0 for no limit. A destination can override it with timeoutMs.",
+		EnvVar: "WRITER_TIMEOUT_MS"})
+	writerAttemptTimeout := app.Int(cli.IntOpt{
+		Name:   "writer-attempt-timeout-ms",
+		Value:  10000,
+		Desc:   "Default time in milliseconds allowed for a single call to a writer before it is abandoned and retried, 0 for no limit. A destination can override it with attemptTimeoutMs.",
+		EnvVar: "WRITER_ATTEMPT_TIMEOUT_MS"})
+	writerBackoffBase := app.Int(cli.IntOpt{
+		Name:   "writer-backoff-base-ms",
+		Value:  100,
+		Desc:   "Backoff in milliseconds before the first retry of a failed writer call. It doubles with every further retry.",
+		EnvVar: "WRITER_BACKOFF_BASE_MS"})
+	writerBackoffMax := app.Int(cli.IntOpt{
+		Name:   "writer-backoff-max-ms",
+		Value:  5000,
+		Desc:   "Maximum backoff in milliseconds between retries of a failed writer call",
+		EnvVar: "WRITER_BACKOFF_MAX_MS"})
+	writerBackoffJitter := app.Int(cli.IntOpt{
+		Name:   "writer-backoff-jitter-percent",
+		Value:  20,
+		Desc:   "Percentage of each backoff that is randomised",
+		EnvVar: "WRITER_BACKOFF_JITTER_PERCENT"})
+	deadLetterSinkType := app.String(cli.StringOpt{
+		Name:   "dead-letter-sink",
+		Value:  "",
+		Desc:   "Where to send concepts that could not be written: 'kafka' publishes them to the dead-letter topic through the kafka proxy, 'file' appends them to the dead-letter file. Leave empty to only log them.",
+		EnvVar: "DEAD_LETTER_SINK"})
+	deadLetterTopic := app.String(cli.StringOpt{
+		Name:   "dead-letter-topic",
+		Value:  "ConceptIngesterDeadLetters",
+		Desc:   "Kafka topic that dead letters are published to",
+		EnvVar: "DEAD_LETTER_TOPIC"})
+	deadLetterFile := app.String(cli.StringOpt{
+		Name:   "dead-letter-file",
+		Value:  "dead-letters.ndjson",
+		Desc:   "File that dead letters are appended to",
+		EnvVar: "DEAD_LETTER_FILE"})
+	deadLetterReplayCapacity := app.Int(cli.IntOpt{
+		Name:   "dead-letter-replay-capacity",
+		Value:  10000,
+		Desc:   "Number of recent dead letters kept in memory for replay when they are published to Kafka",
+		EnvVar: "DEAD_LETTER_REPLAY_CAPACITY"})
 
 	app.Action = func() {
 		httpClient := &http.Client{
@@ -123,7 +435,7 @@ func main() {
 			Topic:                *topic,
 			Offset:               *consumerOffset,
 			AutoCommitEnable:     *consumerAutoCommitEnable,
-			ConcurrentProcessing: true,
+			ConcurrentProcessing: *orderingWorkers == 0, // the ordering workers need the messages in order
 		}
 
 		vulcanBasedRouting := true
@@ -131,47 +443,272 @@ func main() {
 			vulcanBasedRouting = false
 		}
 
-		writerMappings := createWriterMappings(*services, *vulcanAddr, vulcanBasedRouting)
-
 		var elasticsearchWriterBasicMapping string
 		var elasticsearchWriterBulkMapping string
-		if *elasticService != "" {
-			elasticsearchWriterBasicMapping = resolveWriterURL(*elasticService, *vulcanAddr, vulcanBasedRouting)
-			if elasticsearchWriterBasicMapping != "" {
-				elasticsearchWriterBulkMapping = elasticsearchWriterBasicMapping + "/bulk"
+		var routingTable *routingTable
+		var baseURLs []string
+		var err error
+		if *routingConfigFile != "" {
+			log.Infof("Using routing config: %s, the services list and elasticsearch writer are ignored", *routingConfigFile)
+			routingTable, err = loadRoutingConfig(*routingConfigFile)
+			if err != nil {
+				log.Fatalf("Invalid routing configuration: %v", err)
 			}
-			log.Infof("Using writer url: %s for service: %s", elasticsearchWriterBasicMapping, *elasticService)
+			baseURLs = routingTable.healthURLs()
+		} else {
+			writerMappings := createWriterMappings(*services, *vulcanAddr, vulcanBasedRouting)
+			if *elasticService != "" {
+				elasticsearchWriterBasicMapping = resolveWriterURL(*elasticService, *vulcanAddr, vulcanBasedRouting)
+				if elasticsearchWriterBasicMapping != "" {
+					elasticsearchWriterBulkMapping = elasticsearchWriterBasicMapping + "/bulk"
+				}
+				log.Infof("Using writer url: %s for service: %s", elasticsearchWriterBasicMapping, *elasticService)
+			}
+			routingTable, err = newRoutingTable(writerMappings, *routes, elasticsearchWriterBulkMapping, *elasticsearchAfterNeo4j)
+			if err != nil {
+				log.Fatalf("Invalid routing configuration: %v", err)
+			}
+			baseURLs = getBaseURLs(writerMappings)
+		}
+		routingTable.logRoutes()
+		if *deliveryMode != "sequential" && *deliveryMode != "parallel" {
+			log.Fatalf("Unknown delivery mode: %s", *deliveryMode)
+		}
+
+		deletes, err := newDeleteDetector(*deleteTypeSuffix, *deleteOnEmptyBody, *deleteMarker)
+		if err != nil {
+			log.Fatalf("Invalid delete configuration: %v", err)
 		}
 
 		ing := ingesterService{
-			baseURLMappings:  writerMappings,
-			elasticWriterURL: elasticsearchWriterBulkMapping,
-			ticker:           time.NewTicker(time.Second / time.Duration(*throttle)),
+			inFlight:         newInFlightMessages(),
+			deletes:          deletes,
+			routes:           routingTable,
+			limits:           newRateLimiter(rateLimit{Rate: float64(*throttle), Burst: *throttleBurst}, rateLimit{Rate: float64(*writerThrottle), Burst: *writerThrottleBurst}),
 			client:           httpClient,
+			parallelDelivery: *deliveryMode == "parallel",
+			retry: retryPolicy{
+				maxAttempts: *writerMaxAttempts,
+				baseBackoff: time.Duration(*writerBackoffBase) * time.Millisecond,
+				maxBackoff:  time.Duration(*writerBackoffMax) * time.Millisecond,
+				jitter:      float64(*writerBackoffJitter) / 100,
+			},
+			timeouts: deliveryTimeouts{
+				total:   time.Duration(*writerTimeout) * time.Millisecond,
+				attempt: time.Duration(*writerAttemptTimeout) * time.Millisecond,
+			},
+		}
+
+		limitOverrides, err := parseRateLimits(*rateLimits)
+		if err != nil {
+			log.Fatalf("Invalid rate limits: %v", err)
+		}
+		for key, limit := range limitOverrides {
+			if err := ing.limits.set(key, limit); err != nil {
+				log.Fatalf("Invalid rate limits: %v", err)
+			}
+		}
+
+		var healthChecks []fthealth.Check
+		if *adaptiveThrottling {
+			ing.adaptive = newAdaptiveThrottle(ing.limits, float64(*adaptiveMinRate), float64(*adaptiveMaxRate), *writerThrottleBurst,
+				time.Duration(*adaptiveLatencyThreshold)*time.Millisecond, float64(*adaptiveErrorThreshold)/100)
+			go ing.adaptive.run(time.Duration(*adaptiveInterval) * time.Millisecond)
+			healthChecks = append(healthChecks, ing.adaptive.healthCheck())
+			log.Infof("Adaptive throttling writers between %d/s and %d/s", *adaptiveMinRate, *adaptiveMaxRate)
+		}
+
+		if *breakerFailureThreshold > 0 {
+			if *breakerMode != "fail" && *breakerMode != "park" {
+				log.Fatalf("Unknown circuit breaker mode: %s", *breakerMode)
+			}
+			ing.breakers = newCircuitBreakers(*breakerFailureThreshold, time.Duration(*breakerOpenTimeout)*time.Millisecond, *breakerMode == "park")
+			healthChecks = append(healthChecks, ing.breakers.healthCheck())
+		}
+
+		if *bulkSize > 1 {
+			ing.bulk = newBulkWriter(*bulkSize, time.Duration(*bulkFlushInterval)*time.Millisecond, httpClient)
+			log.Infof("Batching up to %d concepts per bulk request, flushing every %dms", *bulkSize, *bulkFlushInterval)
+		}
+
+		var deadLetters deadLetterStore
+		switch *deadLetterSinkType {
+		case "kafka":
+			deadLetters = newMemoryDeadLetterStore(*deadLetterReplayCapacity, newProxyDeadLetterSink(consumerConfig.Addrs[0], *consumerQueue, *deadLetterTopic, httpClient))
+			log.Infof("Dead letters will be published to topic: %s", *deadLetterTopic)
+		case "file":
+			deadLetters = newFileDeadLetterSink(*deadLetterFile)
+			log.Infof("Dead letters will be appended to file: %s", *deadLetterFile)
+		case "":
+		default:
+			log.Fatalf("Unknown dead-letter sink: %s", *deadLetterSinkType)
+		}
+
+		ing.uuids, err = parseUUIDPolicy(*uuidMismatch)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		ing.forceWrites = *forceWrites
+		if *unchangedTTL > 0 {
+			ing.fingerprints = newContentFingerprints(newMemoryDedupStore(time.Duration(*unchangedTTL)*time.Millisecond, *unchangedCapacity))
+			log.Infof("Skipping writes of content written in the last %dms", *unchangedTTL)
+		}
+
+		switch *staleMode {
+		case "drop", "dead-letter":
+			if *staleMode == "dead-letter" && deadLetters == nil {
+				log.Fatalf("Stale updates can only be dead-lettered with a dead-letter sink")
+			}
+			ing.stale = newStaleUpdates(*timestampHeader, *staleMode == "dead-letter",
+				newMemoryDedupStore(time.Duration(*staleTTL)*time.Millisecond, *staleCapacity))
+		case "allow":
+		default:
+			log.Fatalf("Unknown stale updates mode: %s", *staleMode)
+		}
+
+		if *dedupTTL > 0 {
+			ing.dedup = newDeduplicator(newMemoryDedupStore(time.Duration(*dedupTTL)*time.Millisecond, *dedupCapacity), *dedupBody)
+			log.Infof("Skipping messages delivered in the last %dms", *dedupTTL)
+		}
+
+		if *schemaDir != "" {
+			ing.schemas, err = newSchemaValidator(*schemaDir)
+			if err != nil {
+				log.Fatalf("Invalid schemas: %v", err)
+			}
+		}
+
+		switch *rejectionSinkType {
+		case "kafka":
+			ing.rejections = newProxyDeadLetterSink(consumerConfig.Addrs[0], *consumerQueue, *rejectionTopic, httpClient)
+			log.Infof("Rejected concepts will be published to topic: %s", *rejectionTopic)
+		case "file":
+			ing.rejections = newFileDeadLetterSink(*rejectionFile)
+			log.Infof("Rejected concepts will be appended to file: %s", *rejectionFile)
+		case "":
+		default:
+			log.Fatalf("Unknown rejection sink: %s", *rejectionSinkType)
+		}
+
+		adminHandlers := []adminHandler{&throttleHandler{limiter: ing.limits}}
+		if *dryRun {
+			ing.dryRun = newDryRunRecorder()
+			adminHandlers = append(adminHandlers, &dryRunHandler{recorder: ing.dryRun})
+			deadLetters = nil
+			ing.rejections = nil
+			log.Warn("Dry run: nothing will be written or dead-lettered, see /__dry-run for what would have been sent")
+		}
+		if deadLetters != nil {
+			ing.deadLetters = deadLetters
+			adminHandlers = append(adminHandlers, &deadLetterHandler{store: deadLetters, ing: ing})
 		}
 
 		outputMetricsIfRequired(*graphiteTCPAddress, *graphitePrefix, *logMetrics)
 
-		consumer := queueConsumer.NewConsumer(consumerConfig, ing.readMessage, httpClient)
+		if *input != "" {
+			summary, err := ing.backfill(context.Background(), strings.Split(*input, ","), *inputWorkers)
+			if err != nil {
+				log.Fatalf("Cannot backfill: %v", err)
+			}
+			log.Infof("Backfill finished, %v", summary)
+			if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+				log.Errorf("Cannot write backfill summary: %v", err)
+			}
+			if summary.Failed > 0 || summary.Invalid > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
+		if *source != "proxy" && *source != "kafka" {
+			log.Fatalf("Unknown message source: %s", *source)
+		}
+		var kafkaConfig *sarama.Config
+		if *source == "kafka" {
+			if kafkaConfig, err = newKafkaConfig(*kafkaVersion, *consumerOffset); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		windows, err := parseCoalesceWindows(*coalesceWindows)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if len(windows) > 0 {
+			if *manualCommit {
+				log.Fatalf("Coalesce windows cannot be used with manual commit, held back messages would be committed before they are delivered")
+			}
+			ing.coalesce = newCoalescer(windows, ing.handleImmediately)
+			log.Infof("Coalescing updates with windows %v", windows)
+		}
 
-		var wg sync.WaitGroup
-		wg.Add(1)
+		if *orderingWorkers > 0 && *source == "kafka" {
+			log.Fatalf("Ordering workers cannot be used with the kafka source, it already handles the messages of each partition in order")
+		}
+		if *orderingWorkers > 0 {
+			ing.ordering = newKeyedWorkers(*orderingWorkers, *orderingQueueSize, func(msg queueConsumer.Message) error {
+				return ing.handleMessage(context.Background(), msg)
+			})
+			log.Infof("Handling messages with %d workers, in order for each concept", *orderingWorkers)
+		}
+		newConsumer := func() (messageSource, error) {
+			handler := func(msg queueConsumer.Message) error {
+				return ing.handleMessage(context.Background(), msg)
+			}
+			if *source == "kafka" {
+				if !*manualCommit {
+					// without manual commit a message counts as consumed whether or not it was delivered
+					handler = func(msg queueConsumer.Message) error {
+						ing.readMessage(msg)
+						return nil
+					}
+				}
+				consumer, err := newKafkaConsumer(strings.Split(*kafkaBrokers, ","), *consumerGroupID, *topic, kafkaConfig, handler, time.Second)
+				if err != nil {
+					return nil, err
+				}
+				return consumer, nil
+			}
+			if *manualCommit {
+				consumer := newCommittingConsumer(consumerConfig, handler, time.Second, httpClient)
+				if ing.ordering != nil {
+					consumer.dispatch = ing.ordering.submit
+				}
+				return consumer, nil
+			}
+			if ing.ordering != nil {
+				return queueConsumer.NewConsumer(consumerConfig, ing.ordering.handle, httpClient), nil
+			}
+			return queueConsumer.NewConsumer(consumerConfig, ing.readMessage, httpClient), nil
+		}
+		if *source == "kafka" {
+			log.Infof("Consuming topic %s from Kafka brokers %s", *topic, *kafkaBrokers)
+		}
+		if *manualCommit {
+			log.Info("Offsets will only be committed once every message of a batch has been delivered or dead-lettered")
+		}
+		consumer, err := newConsumer()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if *pauseOnUnhealthyWriters {
+			requiredWriters := &HealthCheck{baseURLs: routingTable.requiredHealthURLs(), client: httpClient}
+			consumer = newPausableConsumer(consumer, newConsumer, requiredWriters.checkWritersWithTimeout, time.Duration(*writerHealthInterval)*time.Millisecond)
+			log.Infof("Consumption will pause while any of these writers is unhealthy: %v", requiredWriters.baseURLs)
+		}
 
-		go func() {
-			consumer.Start()
-			wg.Done()
-		}()
+		go consumer.Start()
 
-		go runServer(consumer, ing.baseURLMappings, elasticsearchWriterBasicMapping, *port, httpClient)
+		server := &http.Server{Addr: ":" + *port}
+		go runServer(server, consumer, baseURLs, elasticsearchWriterBasicMapping, httpClient, adminHandlers, healthChecks)
 
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 
 		<-ch
 		log.Println("Shutting down application...")
 
-		consumer.Stop()
-		wg.Wait()
+		shutdown(consumer, ing, server, time.Duration(*shutdownGracePeriod)*time.Millisecond)
 
 		log.Println("Application closing")
 	}
@@ -199,7 +736,7 @@ func resolveWriterURL(service string, vulcanAddr string, vulcanBasedRouting bool
 	return vulcanAddr + "/__" + service
 }
 
-func runServer(consumer queueConsumer.MessageConsumer, baseURLMappings map[string]string, elasticsearchWriter string, port string, client *http.Client) {
+func runServer(server *http.Server, consumer messageSource, baseURLs []string, elasticsearchWriter string, client *http.Client, adminHandlers []adminHandler, healthChecks []fthealth.Check) {
 	var includeElasticsearchWriter bool
 	if elasticsearchWriter != "" {
 		includeElasticsearchWriter = true
@@ -208,20 +745,24 @@ func runServer(consumer queueConsumer.MessageConsumer, baseURLMappings map[strin
 		includeElasticsearchWriter: includeElasticsearchWriter,
 		elasticsearchWriterUrl:     elasticsearchWriter,
 	}
-	r := router(NewHealthCheck(consumer, getBaseURLs(baseURLMappings), eWC, client))
+	hc := NewHealthCheck(consumer, baseURLs, eWC, client)
+	hc.additionalChecks = healthChecks
+	r := router(hc, adminHandlers...)
 
 	// The following endpoints should not be monitored or logged (varnish calls one of these every second, depending on config)
 	// The top one of these build info endpoints feels more correct, but the lower one matches what we have in Dropwizard,
 	// so it's what apps expect currently same as ping, the content of build-info needs more definition
-	http.HandleFunc(status.PingPath, status.PingHandler)
-	http.HandleFunc(status.PingPathDW, status.PingHandler)
-	http.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
-	http.HandleFunc(status.BuildInfoPathDW, status.BuildInfoHandler)
-	log.Infof("concept-ingester-go-app will listen on port: %s", port)
+	mux := http.NewServeMux()
+	mux.HandleFunc(status.PingPath, status.PingHandler)
+	mux.HandleFunc(status.PingPathDW, status.PingHandler)
+	mux.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
+	mux.HandleFunc(status.BuildInfoPathDW, status.BuildInfoHandler)
+	log.Infof("concept-ingester-go-app will listen on port: %s", strings.TrimPrefix(server.Addr, ":"))
 
-	http.Handle("/", r)
+	mux.Handle("/", r)
+	server.Handler = mux
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Unable to start server: %v\n", err)
 	}
 }
@@ -234,11 +775,19 @@ func getBaseURLs(baseURLMappings map[string]string) []string {
 	return URLs
 }
 
-func router(hc *HealthCheck) http.Handler {
+// adminHandler is implemented by anything that serves operational endpoints next to the healthchecks.
+type adminHandler interface {
+	registerHandlers(r *mux.Router)
+}
+
+func router(hc *HealthCheck, adminHandlers ...adminHandler) http.Handler {
 	servicesRouter := mux.NewRouter()
 
 	servicesRouter.HandleFunc("/__health", hc.Health())
 	servicesRouter.HandleFunc(status.GTGPath, status.NewGoodToGoHandler(hc.GTG))
+	for _, h := range adminHandlers {
+		h.registerHandlers(servicesRouter)
+	}
 
 	var monitoringRouter http.Handler = servicesRouter
 	monitoringRouter = httphandlers.TransactionAwareRequestLoggingHandler(log.StandardLogger(), monitoringRouter)
@@ -248,78 +797,223 @@ func router(hc *HealthCheck) http.Handler {
 }
 
 type ingesterService struct {
-	baseURLMappings  map[string]string
-	elasticWriterURL string
-	client           *http.Client
-	ticker           *time.Ticker
+	routes      *routingTable
+	client      *http.Client
+	retry       retryPolicy
+	deadLetters deadLetterSink
+	deletes     deleteDetector
+	// limits throttles messages by type and concepts by writer. When nil nothing is throttled.
+	limits *rateLimiter
+	// adaptive adjusts the writer limits from the writers' latency and errors. When nil the limits are fixed.
+	adaptive *adaptiveThrottle
+	// breakers stop writers that keep failing from being called for a while. When nil writers are always called.
+	breakers *circuitBreakers
+	// bulk batches writes to destinations with a bulk URL. When nil every concept is sent on its own.
+	bulk *bulkWriter
+	// inFlight tracks the messages being handled, so that shutdown can wait for them. When nil nothing is tracked.
+	inFlight *inFlightMessages
+	// uuids decides which UUID a concept is written under when its Message-Id and body disagree. The zero value
+	// rejects the concept.
+	uuids uuidPolicy
+	// coalesce holds back the messages of some types so that only the latest version of a concept is delivered.
+	// When nil every message is delivered.
+	coalesce *coalescer
+	// ordering handles the messages for each concept in order. When nil messages are handled as they are consumed.
+	ordering *keyedWorkers
+	// fingerprints skip writes of content a destination already has. When nil every write is sent.
+	fingerprints *contentFingerprints
+	// forceWrites sends every write, even of content a destination already has
+	forceWrites bool
+	// stale skips messages published before the last message applied to their concept. When nil messages are
+	// applied in the order they arrive.
+	stale *staleUpdates
+	// dedup skips messages that were delivered recently. When nil every message is delivered.
+	dedup *deduplicator
+	// schemas validates concepts before they are routed. When nil concepts are not validated.
+	schemas *schemaValidator
+	// rejections receives the concepts that failed validation. When nil they are only logged.
+	rejections deadLetterSink
+	// dryRun records the requests that would have been sent instead of sending them. When nil requests are sent.
+	dryRun *dryRunRecorder
+	// timeouts are the default delivery timeouts of destinations that don't set their own
+	timeouts deliveryTimeouts
+	// parallelDelivery sends a message to all of its destinations at once, apart from those that must wait for others
+	parallelDelivery bool
 }
 
 func (ing ingesterService) readMessage(msg queueConsumer.Message) {
-	<-ing.ticker.C
-	err := ing.processMessage(msg)
-	if err != nil {
-		log.Errorf("%v", err)
+	ing.handleMessage(context.Background(), msg)
+}
+
+// handleMessage processes the message and dead-letters it if it fails, or rejects it if it is invalid. Messages of
+// types with a coalesce window are held back and handled later, so they count as handled. It returns
+// an error if the message was neither delivered nor set aside, in which case it must not be committed.
+func (ing ingesterService) handleMessage(ctx context.Context, msg queueConsumer.Message) error {
+	ingestionType, uuid, _ := extractMessageTypeAndId(msg.Headers)
+	ingestionType, _ = ing.deletes.detect(ingestionType, msg.Body)
+	if ing.coalesce.add(ingestionType, uuid, msg) {
+		return nil
 	}
+	return ing.handleImmediately(ctx, msg)
 }
 
-func (ing ingesterService) processMessage(msg queueConsumer.Message) error {
-	ingestionType, uuid, transactionID := extractMessageTypeAndId(msg.Headers)
+// handleImmediately is handleMessage without coalescing.
+func (ing ingesterService) handleImmediately(ctx context.Context, msg queueConsumer.Message) error {
+	if handled := ing.handle(ctx, msg); handled.err != nil && !handled.setAside() {
+		return handled.err
+	}
+	return nil
+}
 
-	writerUrl, err := resolveWriter(ingestionType, ing.baseURLMappings)
-	if err != nil {
-		failureMeter := metrics.GetOrRegisterMeter(ingestionType+"-FAILURE", metrics.DefaultRegistry)
-		failureMeter.Mark(1)
-		log.Infof("Incremented failure count, new count=%d for meter=%s", failureMeter.Count(), ingestionType+"-FAILURE")
-		return err
+// handledMessage is what became of a message: its delivery outcomes and, when it was not delivered, why and whether
+// it was set aside instead.
+type handledMessage struct {
+	outcomes     []deliveryOutcome
+	err          error
+	rejected     bool
+	deadLettered bool
+	dropped      bool
+}
+
+func (h handledMessage) setAside() bool {
+	return h.rejected || h.deadLettered || h.dropped
+}
+
+// handle delivers the message and, when that fails, rejects, dead-letters or drops it.
+func (ing ingesterService) handle(ctx context.Context, msg queueConsumer.Message) handledMessage {
+	ingestionType, uuid, _ := extractMessageTypeAndId(msg.Headers)
+	ingestionType, _ = ing.deletes.detect(ingestionType, msg.Body)
+	defer ing.inFlight.add(ingestionType, uuid)()
+	ing.limits.wait(typeLimit, ingestionType)
+	outcomes, err := ing.processMessage(ctx, msg)
+	handled := handledMessage{outcomes: outcomes, err: err}
+	for _, outcome := range outcomes {
+		if outcome.Err != nil && !outcome.Required {
+			log.Warnf("Best-effort delivery to %s failed: %v", outcome.Destination, outcome.Err)
+		}
+	}
+	if err == nil {
+		return handled
+	}
+	log.Errorf("%v", err)
+	if _, invalid := err.(*validationError); invalid {
+		handled.rejected = ing.reject(msg, err)
+		return handled
 	}
+	if handled.deadLettered = ing.deadLetter(msg, err); handled.deadLettered {
+		return handled
+	}
+	if ing.deadLetters == nil && isPermanent(err) {
+		// without a dead-letter sink a message that can never be written would hold up its partition forever
+		droppedMeter := metrics.GetOrRegisterMeter(ingestionType+"-DROPPED", metrics.DefaultRegistry)
+		droppedMeter.Mark(1)
+		log.Errorf("Dropping %s with uuid: %s, it was rejected by its writer and there is no dead-letter sink", ingestionType, uuid)
+		handled.dropped = true
+	}
+	return handled
+}
 
-	err = sendToWriter(ingestionType, msg.Body, uuid, transactionID, writerUrl, ing.client)
+// processMessage delivers the message to each of its destinations and reports the outcome for each of them.
+// It fails if any required destination fails or is skipped. A duplicate of a message delivered recently, or a message
+// published before the last one applied to its concept, is skipped without any outcomes.
+func (ing ingesterService) processMessage(ctx context.Context, msg queueConsumer.Message) ([]deliveryOutcome, error) {
+	ingestionType, uuid, transactionID := extractMessageTypeAndId(msg.Headers)
+	ingestionType, deleted := ing.deletes.detect(ingestionType, msg.Body)
+	uuid, err := ing.uuids.resolve(ingestionType, uuid, msg.Body)
 	if err != nil {
-		failureMeter := metrics.GetOrRegisterMeter(ingestionType+"-FAILURE", metrics.DefaultRegistry)
-		failureMeter.Mark(1)
-		log.Infof("Incremented failure count, new count=%d for meter=%s", failureMeter.Count(), ingestionType+"-FAILURE")
-		return err
+		markInvalid(ingestionType)
+		return nil, err
+	}
+	d := delivery{ingestionType: ingestionType, uuid: uuid, transactionID: transactionID, body: msg.Body, deleted: deleted,
+		force: ing.forceWrites || msg.Headers[forceWriteHeader] == "true"}
+	if ing.dedup.duplicate(d) {
+		return nil, nil
+	}
+	if err := ing.stale.check(d, msg.Headers); err != nil {
+		if ing.stale.deadLetter {
+			return nil, err
+		}
+		log.Infof("Dropping %v", err)
+		return nil, nil
 	}
 
-	if ing.elasticWriterURL != "" {
-		err = sendToWriter(ingestionType, msg.Body, uuid, transactionID, ing.elasticWriterURL, ing.client)
-		if err != nil {
-			failureMeter := metrics.GetOrRegisterMeter(ingestionType+"-elasticsearch-FAILURE", metrics.DefaultRegistry)
+	if !deleted {
+		if err := ing.schemas.validate(ingestionType, uuid, msg.Body); err != nil {
+			markInvalid(ingestionType)
+			return nil, err
+		}
+	}
+
+	destinations, err := resolveWriter(ingestionType, ing.routes)
+	if err != nil {
+		ing.dryRun.routingError(ingestionType, err)
+		if ing.dryRun == nil {
+			failureMeter := metrics.GetOrRegisterMeter(ingestionType+"-"+d.outcome("FAILURE"), metrics.DefaultRegistry)
 			failureMeter.Mark(1)
-			log.Infof("Incremented failure count, new count=%d for meter=%s", failureMeter.Count(), ingestionType+"-elasticsearch-FAILURE")
-			return err
+			log.Infof("Incremented failure count, new count=%d for meter=%s", failureMeter.Count(), ingestionType+"-"+d.outcome("FAILURE"))
 		}
+		return nil, err
 	}
 
-	successMeter := metrics.GetOrRegisterMeter(ingestionType+"-SUCCESS", metrics.DefaultRegistry)
-	successMeter.Mark(1)
-	return nil
+	ing.dryRun.message(ingestionType)
 
+	var outcomes []deliveryOutcome
+	if ing.parallelDelivery {
+		outcomes = ing.deliverInParallel(ctx, d, destinations)
+	} else {
+		outcomes = ing.deliverSequentially(ctx, d, destinations)
+	}
+	if err := requiredDeliveryError(outcomes); err != nil {
+		return outcomes, err
+	}
+
+	// nothing was written in a dry run, so it is not a success and the same message must not be skipped when it is
+	// delivered for real
+	if ing.dryRun == nil {
+		successMeter := metrics.GetOrRegisterMeter(ingestionType+"-"+d.outcome("SUCCESS"), metrics.DefaultRegistry)
+		successMeter.Mark(1)
+		ing.dedup.processed(d)
+		ing.stale.record(d, msg.Headers)
+	}
+	return outcomes, nil
 }
 
 func extractMessageTypeAndId(headers map[string]string) (string, string, string) {
 	return headers["Message-Type"], headers["Message-Id"], headers["X-Request-Id"]
 }
 
-func sendToWriter(ingestionType string, msgBody string, uuid string, transactionID string, elasticWriter string, client *http.Client) error {
-
-	request, reqURL, err := createWriteRequest(ingestionType, strings.NewReader(msgBody), uuid, elasticWriter)
+func sendToWriter(ctx context.Context, d delivery, dest destination, client *http.Client) error {
+	var request *http.Request
+	var reqURL string
+	var err error
+	if d.deleted {
+		request, reqURL, err = createDeleteRequest(ctx, d.ingestionType, d.uuid, dest)
+	} else {
+		request, reqURL, err = createWriteRequest(ctx, d.ingestionType, strings.NewReader(d.body), d.uuid, dest)
+	}
 	if err != nil {
 		log.Errorf("Cannot create write request: [%v]", err)
+		return err
+	}
+	if !d.deleted {
+		request.ContentLength = -1
 	}
-	request.ContentLength = -1
 
-	if transactionID != "" {
-		request.Header.Set("X-Request-Id", transactionID)
+	if d.transactionID != "" {
+		request.Header.Set("X-Request-Id", d.transactionID)
 	}
 
-	log.Infof("Sending %s with uuid: %s to %s", ingestionType, uuid, elasticWriter)
+	if d.deleted {
+		log.Infof("Deleting %s with uuid: %s from %s", d.ingestionType, d.uuid, dest.Name)
+	} else {
+		log.Infof("Sending %s with uuid: %s to %s", d.ingestionType, d.uuid, dest.Name)
+	}
 
 	resp, reqErr := client.Do(request)
 	if reqErr != nil {
-		return fmt.Errorf("reqURL=[%s] concept=[%s] uuid=[%s] error=[%v]", reqURL, ingestionType, uuid, reqErr)
+		return &writerError{reqURL: reqURL, ingestionType: d.ingestionType, uuid: d.uuid, err: reqErr}
 	}
-	if resp.StatusCode == http.StatusOK {
+	if resp.StatusCode == http.StatusOK || (d.deleted && isDeleted(resp.StatusCode)) {
 		readBody(resp)
 		return nil
 	}
@@ -328,32 +1022,59 @@ func sendToWriter(ingestionType string, msgBody string, uuid string, transaction
 	if err != nil {
 		log.Errorf("Cannot read error body: [%v]", err)
 	}
-	return fmt.Errorf("reqURL=[%s] status=[%d] uuid=[%s] error=[%v] body=[%s]", reqURL, resp.StatusCode, uuid, reqErr, string(errorMessage))
+	return &writerError{reqURL: reqURL, ingestionType: d.ingestionType, uuid: d.uuid, status: resp.StatusCode, body: string(errorMessage)}
 }
 
-func resolveWriter(ingestionType string, URLMappings map[string]string) (string, error) {
-	var writerURL string
-	for service, URL := range URLMappings {
-		if strings.Contains(service, ingestionType) {
-			writerURL = URL
-		}
-	}
-	if writerURL == "" {
-		return "", fmt.Errorf("No configured writer for concept: %v", ingestionType)
+// writerError is returned by sendToWriter when a writer could not be reached or did not accept a concept.
+type writerError struct {
+	reqURL        string
+	ingestionType string
+	uuid          string
+	// status is 0 when no response was received from the writer
+	status int
+	body   string
+	err    error
+}
+
+func (e *writerError) Error() string {
+	if e.status == 0 {
+		return fmt.Sprintf("reqURL=[%s] concept=[%s] uuid=[%s] error=[%v]", e.reqURL, e.ingestionType, e.uuid, e.err)
 	}
+	return fmt.Sprintf("reqURL=[%s] status=[%d] uuid=[%s] error=[%v] body=[%s]", e.reqURL, e.status, e.uuid, e.err, e.body)
+}
 
-	return writerURL, nil
+func resolveWriter(ingestionType string, routes *routingTable) ([]destination, error) {
+	if routes == nil {
+		return nil, fmt.Errorf("No configured writer for concept: %v", ingestionType)
+	}
+	return routes.resolve(ingestionType)
 }
 
-func createWriteRequest(ingestionType string, msgBody io.Reader, uuid string, writerURL string) (*http.Request, string, error) {
+func createWriteRequest(ctx context.Context, ingestionType string, msgBody io.Reader, uuid string, dest destination) (*http.Request, string, error) {
 
-	reqURL := writerURL + "/" + ingestionType + "/" + uuid
+	reqURL := dest.url(ingestionType, uuid)
 
-	request, err := http.NewRequest("PUT", reqURL, msgBody)
+	request, err := http.NewRequest(dest.Method, reqURL, msgBody)
 	if err != nil {
 		return nil, reqURL, fmt.Errorf("Failed to create request to %v with body %v", reqURL, msgBody)
 	}
-	return request, reqURL, err
+	return request.WithContext(ctx), reqURL, err
+}
+
+func createDeleteRequest(ctx context.Context, ingestionType string, uuid string, dest destination) (*http.Request, string, error) {
+
+	reqURL := dest.deleteURL(ingestionType, uuid)
+
+	request, err := http.NewRequest("DELETE", reqURL, nil)
+	if err != nil {
+		return nil, reqURL, fmt.Errorf("Failed to create delete request to %v", reqURL)
+	}
+	return request.WithContext(ctx), reqURL, err
+}
+
+// isDeleted reports whether a writer's response to a DELETE means the concept is gone. A 404 counts, as the concept may never have been written.
+func isDeleted(status int) bool {
+	return status == http.StatusOK || status == http.StatusNoContent || status == http.StatusNotFound
 }
 
 func readBody(resp *http.Response) {
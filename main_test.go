@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
 	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var peopleServiceVulcanRouting = "people-rw-neo4j"
@@ -45,9 +48,9 @@ func TestMessageProcessingHappyPathIncrementsSuccessMeter(t *testing.T) {
 
 	successMeterInitialCount, failureMeterInitialCount := getCounts()
 
-	ing := ingesterService{baseURLMappings: mockedWriterMappings, client: &http.Client{}}
+	ing := ingesterService{routes: mustRoutingTable(mockedWriterMappings, ""), client: &http.Client{}}
 
-	err := ing.processMessage(createMessage(uuid, validMessageTypeOrganisations))
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
 
 	assert := assert.New(t)
 	assert.NoError(err, "Should complete without error")
@@ -72,9 +75,9 @@ func TestMessageProcessingUnhappyPathIncrementsFailureMeter(t *testing.T) {
 
 	successMeterInitialCount, failureMeterInitialCount := getCounts()
 
-	ing := ingesterService{baseURLMappings: mockedWriterMappings, client: &http.Client{}}
+	ing := ingesterService{routes: mustRoutingTable(mockedWriterMappings, ""), client: &http.Client{}}
 
-	err := ing.processMessage(createMessage(uuid, validMessageTypeOrganisations))
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
 
 	assert := assert.New(t)
 	assert.Error(err, "Should error")
@@ -100,9 +103,9 @@ func TestMessageProcessingHappyPathIncrementsSuccessMeterForElasticsearchInclude
 	successMeterInitialCount, failureMeterInitialCount := getCounts()
 	failureMeterInitialCountForElasticsearch := getElasticsearchCount()
 
-	ing := ingesterService{baseURLMappings: mockedWriterMappings, elasticWriterURL: server.URL, client: &http.Client{}}
+	ing := ingesterService{routes: mustRoutingTable(mockedWriterMappings, server.URL), client: &http.Client{}}
 
-	err := ing.processMessage(createMessage(uuid, validMessageTypeOrganisations))
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
 
 	assert := assert.New(t)
 	assert.NoError(err, "Should complete without error")
@@ -134,9 +137,9 @@ func TestMessageProcessingUnhappyPathIncrementsFailureMeterWithElasticsearch(t *
 	successMeterInitialCount, failureMeterInitialCount := getCounts()
 	failureMeterInitialCountForElasticsearch := getElasticsearchCount()
 
-	ing := ingesterService{baseURLMappings: mockedWriterMappings, elasticWriterURL: server.URL + "/bulk", client: &http.Client{}}
+	ing := ingesterService{routes: mustRoutingTable(mockedWriterMappings, server.URL+"/bulk"), client: &http.Client{}}
 
-	err := ing.processMessage(createMessage(uuid, validMessageTypeOrganisations))
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
 
 	assert := assert.New(t)
 	assert.Error(err, "Should error")
@@ -149,6 +152,68 @@ func TestMessageProcessingUnhappyPathIncrementsFailureMeterWithElasticsearch(t *
 	assert.True(failureMeterFinalCountForElasticsearch-failureMeterInitialCountForElasticsearch == 1, "Should have incremented FailureCount by 1")
 }
 
+func TestMessageIsFannedOutToEveryDestination(t *testing.T) {
+	var paths []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/cache") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/neo4j/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: elasticsearchDestination, URLTemplate: server.URL + "/bulk/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: "public-concepts-cache", URLTemplate: server.URL + "/cache/{uuid}", Method: "POST"},
+	})
+	successMeterInitialCount, _ := getCounts()
+	cacheFailureInitialCount := metrics.GetOrRegisterMeter("organisations-public-concepts-cache-FAILURE", metrics.DefaultRegistry).Count()
+
+	ing := ingesterService{routes: routes, client: &http.Client{}}
+	outcomes, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert := assert.New(t)
+	assert.NoError(err, "A best-effort failure should not fail the message")
+	assert.Equal([]string{"PUT /neo4j/organisations/" + uuid, "PUT /bulk/organisations/" + uuid, "POST /cache/" + uuid}, paths)
+	require.Len(t, outcomes, 3)
+	assert.NoError(outcomes[0].Err)
+	assert.NoError(outcomes[1].Err)
+	assert.Error(outcomes[2].Err)
+	assert.False(outcomes[2].Required)
+
+	successMeterFinalCount, _ := getCounts()
+	assert.Equal(int64(1), successMeterFinalCount-successMeterInitialCount)
+	assert.Equal(int64(1), metrics.GetOrRegisterMeter("organisations-public-concepts-cache-FAILURE", metrics.DefaultRegistry).Count()-cacheFailureInitialCount)
+}
+
+func TestRequiredDestinationFailureSkipsTheRemainingDestinations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	routes := newEmptyRoutingTable()
+	routes.addRoute("organisations", []destination{
+		{Name: neo4jDestination, URLTemplate: server.URL + "/{type}/{uuid}", Method: "PUT", Required: true},
+		{Name: "public-concepts-cache", URLTemplate: server.URL + "/cache/{uuid}", Method: "PUT"},
+	})
+
+	ing := ingesterService{routes: routes, client: &http.Client{}}
+	outcomes, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert.Error(t, err)
+	require.Len(t, outcomes, 2)
+	assert.Error(t, outcomes[0].Err)
+	assert.True(t, outcomes[1].Skipped)
+}
+
 func getCounts() (int64, int64) {
 	successMeter := metrics.GetOrRegisterMeter("organisations-SUCCESS", metrics.DefaultRegistry)
 	failureMeter := metrics.GetOrRegisterMeter("organisations-FAILURE", metrics.DefaultRegistry)
@@ -229,8 +294,9 @@ func TestWriterUrlIsResolvedCorrectlyAndRequestIsNotNull(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		writerUrl, err := resolveWriter(validMessageTypeOrganisations, test.mappings)
-		request, actualReqURL, err := createWriteRequest(validMessageTypeOrganisations, strings.NewReader(test.validMessage.Body), uuid, writerUrl)
+		destinations, err := resolveWriter(validMessageTypeOrganisations, mustRoutingTable(test.mappings, ""))
+		assert.NoError(err, fmt.Sprintf("%s: Resolving writer returns an error.", test.name))
+		request, actualReqURL, err := createWriteRequest(context.Background(), validMessageTypeOrganisations, strings.NewReader(test.validMessage.Body), uuid, destinations[0])
 		assert.NoError(err, fmt.Sprintf("%s: Creating write request returns an error.", test.name))
 		assert.Equal(test.expectedReqURL, actualReqURL, fmt.Sprintf("%s: Writer request URL is incorrect.", test.name))
 		assert.NotNil(request, fmt.Sprintf("%s: Writer request is nil.", test.name))
@@ -254,12 +320,20 @@ func TestErrorIsThrownWhenIngestionTypeMatchesNoWriters(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		writerUrl, err := resolveWriter(invalidMessageType, test.mappings)
-		assert.Equal("", writerUrl, fmt.Sprintf("%s: Writer URL is not empty.", test.name))
+		destinations, err := resolveWriter(invalidMessageType, mustRoutingTable(test.mappings, ""))
+		assert.Empty(destinations, fmt.Sprintf("%s: Writer URL is not empty.", test.name))
 		assert.Error(err, "No configured writer for concept: "+invalidMessageType, fmt.Sprintf("%s: Error not returned from resolving writer.", test.name))
 	}
 }
 
+func mustRoutingTable(writerMappings map[string]string, elasticWriterURL string) *routingTable {
+	routes, err := newRoutingTable(writerMappings, "", elasticWriterURL, true)
+	if err != nil {
+		panic(err)
+	}
+	return routes
+}
+
 func createMessage(messageID string, messageType string) queueConsumer.Message {
 	return queueConsumer.Message{
 		Headers: map[string]string{
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// keyedWorkers handles the messages for a concept one at a time and in the order they were submitted, so that an
+// older update cannot overtake a newer one, while messages for different concepts are handled concurrently.
+// Each concept UUID, from the Message-Id header, always goes to the same worker.
+type keyedWorkers struct {
+	handler func(msg queueConsumer.Message) error
+	queues  []chan keyedJob
+
+	mu      sync.Mutex
+	pending int
+}
+
+type keyedJob struct {
+	msg queueConsumer.Message
+	// result receives the handler's result. When nil, a failure is logged instead.
+	result chan error
+}
+
+// newKeyedWorkers starts the workers. Each has a queue of queueSize messages; submit blocks while the queue of the
+// message's worker is full.
+func newKeyedWorkers(workers int, queueSize int, handler func(msg queueConsumer.Message) error) *keyedWorkers {
+	w := &keyedWorkers{handler: handler}
+	for i := 0; i < workers; i++ {
+		queue := make(chan keyedJob, queueSize)
+		w.queues = append(w.queues, queue)
+		// the gauge reads the depth of the queue whenever metrics are reported
+		name := "ordering-worker-" + strconv.Itoa(i) + "-QUEUE"
+		metrics.Unregister(name)
+		metrics.Register(name, metrics.NewFunctionalGauge(func() int64 { return int64(len(queue)) }))
+		go w.work(queue)
+	}
+	return w
+}
+
+func (w *keyedWorkers) worker(msg queueConsumer.Message) int {
+	_, uuid, _ := extractMessageTypeAndId(msg.Headers)
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return int(h.Sum32() % uint32(len(w.queues)))
+}
+
+// submit queues the message behind the earlier messages for the same concept and returns a channel that receives
+// the handler's result once it has been handled.
+func (w *keyedWorkers) submit(msg queueConsumer.Message) <-chan error {
+	job := keyedJob{msg: msg, result: make(chan error, 1)}
+	w.enqueue(job)
+	return job.result
+}
+
+// handle queues the message like submit, for callers that do not wait for the result. A message that fails is logged,
+// so that it can be replayed.
+func (w *keyedWorkers) handle(msg queueConsumer.Message) {
+	w.enqueue(keyedJob{msg: msg})
+}
+
+func (w *keyedWorkers) enqueue(job keyedJob) {
+	w.mu.Lock()
+	w.pending++
+	w.mu.Unlock()
+	worker := w.worker(job.msg)
+	select {
+	case w.queues[worker] <- job:
+	default:
+		log.Warnf("The queue of ordering worker %d is full, consumption waits until it has room", worker)
+		w.queues[worker] <- job
+	}
+}
+
+func (w *keyedWorkers) work(queue chan keyedJob) {
+	for job := range queue {
+		err := w.handler(job.msg)
+		if job.result != nil {
+			job.result <- err
+		} else if err != nil {
+			ingestionType, uuid, _ := extractMessageTypeAndId(job.msg.Headers)
+			log.Errorf("%s with uuid: %s was neither delivered nor set aside, it may need replaying: %v", ingestionType, uuid, err)
+		}
+		w.mu.Lock()
+		w.pending--
+		w.mu.Unlock()
+	}
+}
+
+// wait waits until every submitted message has been handled or the deadline passes, and returns the number of
+// messages not yet handled. A nil keyedWorkers has nothing to wait for.
+func (w *keyedWorkers) wait(deadline time.Time) int {
+	if w == nil {
+		return 0
+	}
+	for {
+		w.mu.Lock()
+		pending := w.pending
+		w.mu.Unlock()
+		if pending == 0 || !time.Now().Before(deadline) {
+			return pending
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessagesForAConceptAreHandledInOrder(t *testing.T) {
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	workers := newKeyedWorkers(4, 10, func(msg queueConsumer.Message) error {
+		// later messages are quicker, so they would overtake earlier ones if they were handled concurrently
+		if msg.Body == "1" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[msg.Headers["Message-Id"]] = append(handled[msg.Headers["Message-Id"]], msg.Body)
+		return nil
+	})
+
+	var results []<-chan error
+	for _, body := range []string{"1", "2", "3"} {
+		for _, id := range []string{uuid, otherUUID} {
+			msg := createMessage(id, validMessageTypeOrganisations)
+			msg.Body = body
+			results = append(results, workers.submit(msg))
+		}
+	}
+	for _, result := range results {
+		assert.NoError(t, <-result)
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, handled[uuid])
+	assert.Equal(t, []string{"1", "2", "3"}, handled[otherUUID])
+	assert.Equal(t, 0, workers.wait(time.Now()))
+}
+
+func TestDifferentConceptsAreHandledConcurrently(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	workers := newKeyedWorkers(2, 10, func(msg queueConsumer.Message) error {
+		if msg.Headers["Message-Id"] == uuid {
+			started <- struct{}{}
+			<-release
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if workers.worker(createMessage(uuid, "")) == workers.worker(createMessage(otherUUID, "")) {
+		t.Skip("Both concepts hash to the same worker")
+	}
+
+	blocked := workers.submit(createMessage(uuid, validMessageTypeOrganisations))
+	queued := workers.submit(createMessage(uuid, validMessageTypeOrganisations))
+	assert.NoError(t, <-workers.submit(createMessage(otherUUID, validMessageTypeOrganisations)), "A concept should not wait for another one")
+	<-started
+
+	gauge := metrics.GetOrRegisterGauge("ordering-worker-"+strconv.Itoa(workers.worker(createMessage(uuid, "")))+"-QUEUE", metrics.DefaultRegistry)
+	assert.Equal(t, int64(1), gauge.Value(), "The message behind the blocked one should be queued")
+	assert.Equal(t, 2, workers.wait(time.Now()))
+
+	close(release)
+	require.Error(t, <-blocked)
+	require.Error(t, <-queued)
+	assert.Equal(t, 0, workers.wait(time.Now().Add(time.Second)))
+}
+
+func TestMessagesHandledWithoutWaitingAreStillTracked(t *testing.T) {
+	handled := make(chan string, 2)
+	workers := newKeyedWorkers(2, 10, func(msg queueConsumer.Message) error {
+		handled <- msg.Headers["Message-Id"]
+		return errors.New("failed")
+	})
+
+	workers.handle(createMessage(uuid, validMessageTypeOrganisations))
+	workers.handle(createMessage(otherUUID, validMessageTypeOrganisations))
+	assert.Equal(t, 0, workers.wait(time.Now().Add(time.Second)), "Failed messages should not be left pending")
+	assert.Len(t, handled, 2)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// pausableConsumer runs a queue consumer only while the writers are healthy. Every interval it checks the writers;
+// when they fail it stops the consumer, so that nothing more is fetched or committed, and when they recover it
+// starts a new one, which carries on from the last committed offset. When the new one cannot be created, consumption
+// stays paused and is resumed at a later check.
+type pausableConsumer struct {
+	newConsumer   func() (messageSource, error)
+	writersHealth func() error
+	interval      time.Duration
+
+	mu       sync.Mutex
+	consumer messageSource
+	// used is true once consumer has been started, after which it cannot be started again
+	used bool
+	// resumeErr is why the last attempt to resume failed, until one succeeds
+	resumeErr error
+	paused    bool
+	running   sync.WaitGroup
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// newPausableConsumer starts with the given consumer and calls newConsumer for each one after it.
+func newPausableConsumer(consumer messageSource, newConsumer func() (messageSource, error), writersHealth func() error, interval time.Duration) *pausableConsumer {
+	return &pausableConsumer{
+		newConsumer:   newConsumer,
+		writersHealth: writersHealth,
+		interval:      interval,
+		consumer:      consumer,
+		paused:        true,
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// Start consumes until Stop is called, pausing while the writers are unhealthy.
+func (pc *pausableConsumer) Start() {
+	defer close(pc.stopped)
+	if err := pc.writersHealth(); err != nil {
+		log.Warnf("Not starting consumption yet, writers are unhealthy: %v", err)
+		metrics.GetOrRegisterMeter("consumer-PAUSE", metrics.DefaultRegistry).Mark(1)
+	} else {
+		// the first consumer has not been used yet, so this cannot fail
+		pc.resume()
+	}
+	ticker := time.NewTicker(pc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pc.stop:
+			pc.pause()
+			return
+		case <-ticker.C:
+			pc.checkWriters()
+		}
+	}
+}
+
+func (pc *pausableConsumer) Stop() {
+	close(pc.stop)
+	<-pc.stopped
+}
+
+func (pc *pausableConsumer) ConnectivityCheck() (string, error) {
+	pc.mu.Lock()
+	consumer, resumeErr := pc.consumer, pc.resumeErr
+	pc.mu.Unlock()
+	if resumeErr != nil {
+		return "Cannot create a consumer to resume consumption", resumeErr
+	}
+	return consumer.ConnectivityCheck()
+}
+
+func (pc *pausableConsumer) isPaused() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.paused
+}
+
+func (pc *pausableConsumer) checkWriters() {
+	err := pc.writersHealth()
+	switch {
+	case err != nil && !pc.isPaused():
+		log.Warnf("Pausing consumption, writers are unhealthy: %v", err)
+		pc.pause()
+		metrics.GetOrRegisterMeter("consumer-PAUSE", metrics.DefaultRegistry).Mark(1)
+	case err == nil && pc.isPaused():
+		log.Info("Resuming consumption, writers are healthy again")
+		if err := pc.resume(); err != nil {
+			log.Errorf("Cannot resume consumption, will retry: %v", err)
+			metrics.GetOrRegisterMeter("consumer-RESUME-FAILURE", metrics.DefaultRegistry).Mark(1)
+			return
+		}
+		metrics.GetOrRegisterMeter("consumer-RESUME", metrics.DefaultRegistry).Mark(1)
+	}
+}
+
+// pause stops the consumer and waits for the messages it is processing to finish.
+func (pc *pausableConsumer) pause() {
+	pc.mu.Lock()
+	consumer := pc.consumer
+	alreadyPaused := pc.paused
+	pc.paused = true
+	pc.mu.Unlock()
+	if alreadyPaused {
+		return
+	}
+	consumer.Stop()
+	pc.running.Wait()
+}
+
+// resume starts consuming again, with a new consumer if the current one has been used.
+func (pc *pausableConsumer) resume() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.paused {
+		return nil
+	}
+	if pc.used {
+		consumer, err := pc.newConsumer()
+		if err != nil {
+			pc.resumeErr = err
+			return err
+		}
+		pc.consumer = consumer
+	}
+	pc.used = true
+	pc.resumeErr = nil
+	pc.paused = false
+	consumer := pc.consumer
+	pc.running.Add(1)
+	go func() {
+		defer pc.running.Done()
+		consumer.Start()
+	}()
+	return nil
+}
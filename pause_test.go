@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsumer runs until it is stopped, like the queue consumer does.
+type fakeConsumer struct {
+	stop chan struct{}
+}
+
+func (c *fakeConsumer) Start()                             { <-c.stop }
+func (c *fakeConsumer) Stop()                              { close(c.stop) }
+func (c *fakeConsumer) ConnectivityCheck() (string, error) { return "", nil }
+
+type fakeConsumers struct {
+	mu      sync.Mutex
+	created int
+	err     error
+}
+
+func (f *fakeConsumers) newConsumer() (messageSource, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.created++
+	return &fakeConsumer{stop: make(chan struct{})}, nil
+}
+
+func (f *fakeConsumers) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func newTestPausableConsumer(consumers *fakeConsumers, health *switchableHealth) *pausableConsumer {
+	first, _ := consumers.newConsumer()
+	return newPausableConsumer(first, consumers.newConsumer, health.check, time.Millisecond)
+}
+
+type switchableHealth struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (h *switchableHealth) set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+}
+
+func (h *switchableHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+func TestConsumptionPausesWhileWritersAreUnhealthy(t *testing.T) {
+	consumers := &fakeConsumers{}
+	health := &switchableHealth{}
+	pauseMeter := metrics.GetOrRegisterMeter("consumer-PAUSE", metrics.DefaultRegistry)
+	resumeMeter := metrics.GetOrRegisterMeter("consumer-RESUME", metrics.DefaultRegistry)
+	pausesBefore, resumesBefore := pauseMeter.Count(), resumeMeter.Count()
+
+	pc := newTestPausableConsumer(consumers, health)
+	go pc.Start()
+
+	waitFor(t, func() bool { return !pc.isPaused() }, "Consumption should start while the writers are healthy")
+
+	health.set(errors.New("Writer http://organisations-rw-neo4j:8080/__gtg returned status 503"))
+	waitFor(t, pc.isPaused, "Consumption should pause once a writer is unhealthy")
+
+	health.set(nil)
+	waitFor(t, func() bool { return !pc.isPaused() }, "Consumption should resume once the writers recover")
+
+	pc.Stop()
+
+	assert.True(t, pc.isPaused())
+	assert.Equal(t, 2, consumers.created, "A stopped consumer cannot be restarted, so a new one should be created to resume")
+	assert.Equal(t, int64(1), pauseMeter.Count()-pausesBefore)
+	assert.Equal(t, int64(1), resumeMeter.Count()-resumesBefore)
+}
+
+func TestConsumptionDoesNotStartWhileWritersAreUnhealthy(t *testing.T) {
+	consumers := &fakeConsumers{}
+	health := &switchableHealth{err: errors.New("unhealthy")}
+
+	pc := newTestPausableConsumer(consumers, health)
+	go pc.Start()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.True(t, pc.isPaused())
+
+	health.set(nil)
+	waitFor(t, func() bool { return !pc.isPaused() }, "Consumption should start once the writers are healthy")
+	pc.Stop()
+
+	assert.Equal(t, 1, consumers.created, "The first consumer should be used as it was never started")
+}
+
+func TestConsumptionStaysPausedWhileANewConsumerCannotBeCreated(t *testing.T) {
+	consumers := &fakeConsumers{}
+	health := &switchableHealth{}
+	failureMeter := metrics.GetOrRegisterMeter("consumer-RESUME-FAILURE", metrics.DefaultRegistry)
+	failuresBefore := failureMeter.Count()
+
+	pc := newTestPausableConsumer(consumers, health)
+	go pc.Start()
+	waitFor(t, func() bool { return !pc.isPaused() }, "Consumption should start while the writers are healthy")
+
+	health.set(errors.New("unhealthy"))
+	waitFor(t, pc.isPaused, "Consumption should pause once a writer is unhealthy")
+
+	consumers.setErr(errors.New("Cannot connect to Kafka brokers [kafka:9092]"))
+	health.set(nil)
+	waitFor(t, func() bool { return failureMeter.Count()-failuresBefore >= 2 }, "Resuming should be retried at every check")
+	assert.True(t, pc.isPaused())
+	_, err := pc.ConnectivityCheck()
+	assert.Error(t, err, "The consumer that could not be created should fail the connectivity check")
+
+	consumers.setErr(nil)
+	waitFor(t, func() bool { return !pc.isPaused() }, "Consumption should resume once a consumer can be created")
+	_, err = pc.ConnectivityCheck()
+	assert.NoError(t, err)
+	pc.Stop()
+
+	assert.Equal(t, 2, consumers.created)
+}
+
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal(msg)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	typeLimit   = "type"
+	writerLimit = "writer"
+	// defaultLimitName is used in place of a message type or writer to address the default limit, e.g. type:*
+	defaultLimitName = "*"
+)
+
+// rateLimit is a token bucket setting: Rate tokens are added per second, up to Burst. A Rate of 0 or less is unlimited.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l rateLimit) String() string {
+	if l.Rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%v/s, burst %d", l.Rate, l.Burst)
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setLimit(limit)
+	b.tokens = float64(b.limit.Burst)
+	return b
+}
+
+// wait takes a token, sleeping until one is available. Tokens are reserved up front, so concurrent callers
+// are released one after the other at the bucket's rate.
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	if b.limit.Rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func (b *tokenBucket) setLimit(limit rateLimit) {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	b.mu.Lock()
+	b.limit = limit
+	b.tokens = math.Min(b.tokens, float64(limit.Burst))
+	b.mu.Unlock()
+}
+
+// rateLimiter holds a token bucket for every message type and every writer seen so far. Buckets start with
+// the limit set for them by name, or else the limit adaptive throttling has given them, or else the default limit
+// for their kind.
+type rateLimiter struct {
+	mu        sync.Mutex
+	defaults  map[string]rateLimit
+	overrides map[string]rateLimit
+	adapted   map[string]rateLimit
+	buckets   map[string]*tokenBucket
+}
+
+func newRateLimiter(typeDefault, writerDefault rateLimit) *rateLimiter {
+	return &rateLimiter{
+		defaults:  map[string]rateLimit{typeLimit: typeDefault, writerLimit: writerDefault},
+		overrides: make(map[string]rateLimit),
+		adapted:   make(map[string]rateLimit),
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// wait blocks until the message type or writer with the given name is allowed another message.
+// A nil rateLimiter never blocks.
+func (rl *rateLimiter) wait(kind string, name string) {
+	if rl == nil {
+		return
+	}
+	key := kind + ":" + name
+	rl.mu.Lock()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		limit, _ := rl.limit(kind, key)
+		bucket = newTokenBucket(limit)
+		rl.buckets[key] = bucket
+	}
+	rl.mu.Unlock()
+	bucket.wait()
+}
+
+// limit returns the limit for a key of the given kind and whether it was set for the key by name. rl.mu must be held.
+func (rl *rateLimiter) limit(kind string, key string) (rateLimit, bool) {
+	if limit, overridden := rl.overrides[key]; overridden {
+		return limit, true
+	}
+	if limit, adapted := rl.adapted[key]; adapted {
+		return limit, false
+	}
+	return rl.defaults[kind], false
+}
+
+// current returns the limit in force for a writer or message type, and whether it was set for it by name through
+// --rate-limits or /__throttle.
+func (rl *rateLimiter) current(kind string, name string) (rateLimit, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.limit(kind, kind+":"+name)
+}
+
+// adapt changes the limit for a writer or message type on behalf of adaptive throttling. A limit set by name takes
+// precedence, so it is left as it is.
+func (rl *rateLimiter) adapt(kind string, name string, limit rateLimit) {
+	key := kind + ":" + name
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, overridden := rl.overrides[key]; overridden {
+		return
+	}
+	rl.adapted[key] = limit
+	if bucket, ok := rl.buckets[key]; ok {
+		bucket.setLimit(limit)
+	}
+}
+
+// set changes the limit for a key of the form type:<message type>, writer:<writer url>, type:* or writer:*.
+// Changing a default applies to every bucket of that kind without a limit of its own.
+func (rl *rateLimiter) set(key string, limit rateLimit) error {
+	kind, name, err := splitRateLimitKey(key)
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if name == defaultLimitName {
+		rl.defaults[kind] = limit
+		for bucketKey, bucket := range rl.buckets {
+			_, overridden := rl.overrides[bucketKey]
+			_, adapted := rl.adapted[bucketKey]
+			if !overridden && !adapted && strings.HasPrefix(bucketKey, kind+":") {
+				bucket.setLimit(limit)
+			}
+		}
+	} else {
+		rl.overrides[key] = limit
+		if bucket, ok := rl.buckets[key]; ok {
+			bucket.setLimit(limit)
+		}
+	}
+	log.Infof("Rate limit for %s set to %v", key, limit)
+	return nil
+}
+
+func splitRateLimitKey(key string) (string, string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 || (parts[0] != typeLimit && parts[0] != writerLimit) || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid rate limit key %q, expected type:<message type> or writer:<writer url>", key)
+	}
+	return parts[0], parts[1], nil
+}
+
+// limits returns the limit in force for the defaults and for every message type and writer seen or configured.
+func (rl *rateLimiter) limits() map[string]rateLimit {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limits := make(map[string]rateLimit)
+	for kind, limit := range rl.defaults {
+		limits[kind+":"+defaultLimitName] = limit
+	}
+	for key, bucket := range rl.buckets {
+		bucket.mu.Lock()
+		limits[key] = bucket.limit
+		bucket.mu.Unlock()
+	}
+	for key, limit := range rl.adapted {
+		limits[key] = limit
+	}
+	for key, limit := range rl.overrides {
+		limits[key] = limit
+	}
+	return limits
+}
+
+// parseRateLimits reads a comma separated list of key=rate or key=rate/burst limits,
+// e.g. type:organisations=100/20,writer:http://people-rw-neo4j:8080=50.
+func parseRateLimits(limits string) (map[string]rateLimit, error) {
+	parsed := make(map[string]rateLimit)
+	for _, entry := range strings.Split(limits, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid rate limit %q, expected key=rate/burst", entry)
+		}
+		key, value := entry[:i], entry[i+1:]
+		var limit rateLimit
+		var err error
+		rate := value
+		if j := strings.Index(value, "/"); j >= 0 {
+			rate = value[:j]
+			if limit.Burst, err = strconv.Atoi(value[j+1:]); err != nil {
+				return nil, fmt.Errorf("Invalid burst in rate limit %q: %v", entry, err)
+			}
+		}
+		if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, fmt.Errorf("Invalid rate in rate limit %q: %v", entry, err)
+		}
+		parsed[key] = limit
+	}
+	return parsed, nil
+}
+
+// throttleHandler serves the admin endpoint used to inspect and change rate limits at runtime.
+type throttleHandler struct {
+	limiter *rateLimiter
+}
+
+func (h *throttleHandler) registerHandlers(r *mux.Router) {
+	r.HandleFunc("/__throttle", h.getLimits).Methods("GET")
+	r.HandleFunc("/__throttle", h.setLimits).Methods("PUT")
+}
+
+func (h *throttleHandler) getLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.limiter.limits())
+}
+
+// setLimits takes a JSON object of key to limit, e.g. {"type:organisations": {"rate": 100, "burst": 20}}.
+func (h *throttleHandler) setLimits(w http.ResponseWriter, r *http.Request) {
+	var limits map[string]rateLimit
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid rate limits: %v", err))
+		return
+	}
+	for key := range limits {
+		if _, _, err := splitRateLimitKey(key); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	for key, limit := range limits {
+		h.limiter.set(key, limit)
+	}
+	writeJSON(w, http.StatusOK, h.limiter.limits())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketAllowsABurstThenThrottles(t *testing.T) {
+	bucket := newTokenBucket(rateLimit{Rate: 50, Burst: 3})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		bucket.wait()
+	}
+	assert.True(t, time.Since(start) < 15*time.Millisecond, "The burst should not be throttled")
+
+	bucket.wait()
+	assert.True(t, time.Since(start) >= 15*time.Millisecond, "Messages beyond the burst should wait for a token")
+}
+
+func TestUnlimitedTokenBucketNeverWaits(t *testing.T) {
+	bucket := newTokenBucket(rateLimit{})
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		bucket.wait()
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+}
+
+func TestRateLimitsAreKeptPerMessageType(t *testing.T) {
+	rl := newRateLimiter(rateLimit{Rate: 10, Burst: 1}, rateLimit{})
+	require.NoError(t, rl.set("type:organisations", rateLimit{Rate: 1, Burst: 1}))
+
+	rl.wait(typeLimit, "organisations")
+	start := time.Now()
+	rl.wait(typeLimit, "people")
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "A busy type should not use up the budget of another")
+
+	limits := rl.limits()
+	assert.Equal(t, rateLimit{Rate: 1, Burst: 1}, limits["type:organisations"])
+	assert.Equal(t, rateLimit{Rate: 10, Burst: 1}, limits["type:people"])
+	assert.Equal(t, rateLimit{}, limits["writer:*"])
+}
+
+func TestChangingADefaultKeepsNamedLimits(t *testing.T) {
+	rl := newRateLimiter(rateLimit{Rate: 10, Burst: 1}, rateLimit{})
+	require.NoError(t, rl.set("type:organisations", rateLimit{Rate: 1, Burst: 1}))
+	rl.wait(typeLimit, "people")
+
+	require.NoError(t, rl.set("type:*", rateLimit{Rate: 100, Burst: 10}))
+
+	limits := rl.limits()
+	assert.Equal(t, rateLimit{Rate: 1, Burst: 1}, limits["type:organisations"])
+	assert.Equal(t, rateLimit{Rate: 100, Burst: 10}, limits["type:people"])
+}
+
+func TestInvalidRateLimitKeyIsRejected(t *testing.T) {
+	rl := newRateLimiter(rateLimit{}, rateLimit{})
+	assert.Error(t, rl.set("organisations", rateLimit{Rate: 1}))
+	assert.Error(t, rl.set("topic:organisations", rateLimit{Rate: 1}))
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("type:organisations=100/20, writer:http://people-rw-neo4j:8080=50")
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]rateLimit{
+		"type:organisations":                 {Rate: 100, Burst: 20},
+		"writer:http://people-rw-neo4j:8080": {Rate: 50},
+	}, limits)
+
+	_, err = parseRateLimits("type:organisations=fast")
+	assert.Error(t, err)
+}
+
+func TestThrottleEndpointChangesLimits(t *testing.T) {
+	rl := newRateLimiter(rateLimit{Rate: 1000, Burst: 1}, rateLimit{})
+	r := adminRouter(&throttleHandler{limiter: rl})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/__throttle", strings.NewReader(`{"type:organisations": {"rate": 5, "burst": 2}}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/__throttle", nil))
+
+	var limits map[string]rateLimit
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&limits))
+	assert.Equal(t, rateLimit{Rate: 5, Burst: 2}, limits["type:organisations"])
+	assert.Equal(t, rateLimit{Rate: 1000, Burst: 1}, limits["type:*"])
+}
+
+func TestThrottleEndpointRejectsInvalidKeys(t *testing.T) {
+	rl := newRateLimiter(rateLimit{Rate: 1000, Burst: 1}, rateLimit{})
+	r := adminRouter(&throttleHandler{limiter: rl})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/__throttle", strings.NewReader(`{"type:organisations": {"rate": 5}, "organisations": {"rate": 5}}`)))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, changed := rl.limits()["type:organisations"]
+	assert.False(t, changed, "No limit should change when one of them is invalid")
+}
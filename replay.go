@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// deadLetterHandler serves the admin endpoints used to inspect dead letters and re-drive them through the ingester.
+type deadLetterHandler struct {
+	store deadLetterStore
+	ing   ingesterService
+
+	// replaying serialises replays, so that a dead letter cannot be replayed twice between being listed and removed
+	replaying sync.Mutex
+}
+
+// replayFailure is the dead-letter sink of a replayed message. A dead letter that fails again stays in the store, so
+// the failure is only recorded.
+type replayFailure struct {
+	err error
+}
+
+func (f *replayFailure) Send(dl deadLetter) error {
+	f.err = errors.New(dl.Error)
+	return nil
+}
+
+type replayResult struct {
+	Replayed []string          `json:"replayed"`
+	Failed   map[string]string `json:"failed"`
+}
+
+func (h *deadLetterHandler) registerHandlers(r *mux.Router) {
+	r.HandleFunc("/__dead-letters", h.listDeadLetters).Methods("GET")
+	r.HandleFunc("/__dead-letters/replay", h.replayDeadLetters).Methods("POST")
+}
+
+func (h *deadLetterHandler) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseDeadLetterFilter(r)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	deadLetters, err := h.store.List(filter)
+	if err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, fmt.Sprintf("Cannot read dead letters: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, deadLetters)
+}
+
+func (h *deadLetterHandler) replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseDeadLetterFilter(r)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.replaying.Lock()
+	defer h.replaying.Unlock()
+	deadLetters, err := h.store.List(filter)
+	if err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, fmt.Sprintf("Cannot read dead letters: %v", err))
+		return
+	}
+
+	result := replayResult{Replayed: make([]string, 0), Failed: make(map[string]string)}
+	for _, dl := range deadLetters {
+		msg := queueConsumer.Message{Headers: dl.Headers, Body: dl.Body}
+		failure := &replayFailure{}
+		ing := h.ing
+		ing.deadLetters = failure
+		err := ing.handleImmediately(r.Context(), msg)
+		if err == nil {
+			err = failure.err
+		}
+		if err != nil {
+			log.Errorf("Replay of dead letter %s failed: %v", dl.ID, err)
+			result.Failed[dl.ID] = err.Error()
+			continue
+		}
+		result.Replayed = append(result.Replayed, dl.ID)
+	}
+
+	if err := h.store.Remove(result.Replayed); err != nil {
+		log.Errorf("Cannot remove replayed dead letters: %v", err)
+	}
+	log.Infof("Replayed %d dead letters, %d failed", len(result.Replayed), len(result.Failed))
+	writeJSON(w, http.StatusOK, result)
+}
+
+// parseDeadLetterFilter reads a filter from the query parameters id (repeatable), type, uuid, writer, from and to.
+// from and to are RFC3339 timestamps.
+func parseDeadLetterFilter(r *http.Request) (deadLetterFilter, error) {
+	query := r.URL.Query()
+	filter := deadLetterFilter{
+		IDs:         query["id"],
+		ConceptType: query.Get("type"),
+		UUID:        query.Get("uuid"),
+		Writer:      query.Get("writer"),
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return filter, fmt.Errorf("Invalid from: %v", err)
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return filter, fmt.Errorf("Invalid to: %v", err)
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return filter, fmt.Errorf("Invalid time window: %s is before %s", filter.To.Format(time.RFC3339), filter.From.Format(time.RFC3339))
+	}
+	return filter, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Cannot write response: %v", err)
+	}
+}
+
+func writeJSONMessage(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var otherUUID = "1b6e6b4a-8f6e-3b2b-9c1e-4c2a1f0d5e6f"
+
+func TestDeadLettersAreListedWithFilters(t *testing.T) {
+	store := newMemoryDeadLetterStore(10, nil)
+	store.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), &writerError{reqURL: "http://organisations-rw-neo4j:8080/organisations/" + uuid, status: 503}))
+	store.Send(newDeadLetter(createMessage(otherUUID, "people"), &writerError{reqURL: "http://people-rw-neo4j:8080/people/" + otherUUID, status: 503}))
+
+	r := adminRouter(&deadLetterHandler{store: store})
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedUUIDs []string
+	}{
+		{"No filter returns all dead letters", "", []string{uuid, otherUUID}},
+		{"Filter by concept type", "?type=people", []string{otherUUID}},
+		{"Filter by uuid", "?uuid=" + uuid, []string{uuid}},
+		{"Filter by writer", "?writer=organisations-rw-neo4j", []string{uuid}},
+		{"Filter by time window", "?from=" + time.Now().Add(time.Hour).Format(time.RFC3339), []string{}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/__dead-letters"+test.query, nil))
+
+		var deadLetters []deadLetter
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&deadLetters), test.name)
+		uuids := make([]string, 0)
+		for _, dl := range deadLetters {
+			uuids = append(uuids, dl.Headers["Message-Id"])
+		}
+		assert.Equal(t, http.StatusOK, w.Code, test.name)
+		assert.Equal(t, test.expectedUUIDs, uuids, test.name)
+	}
+}
+
+func TestInvalidDeadLetterFilterIsRejected(t *testing.T) {
+	r := adminRouter(&deadLetterHandler{store: newMemoryDeadLetterStore(10, nil)})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/__dead-letters?from=yesterday", nil))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid from")
+}
+
+func TestReplayRedrivesDeadLettersAndRemovesTheReplayedOnes(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	store := newMemoryDeadLetterStore(10, nil)
+	store.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("writer unavailable")))
+	store.Send(newDeadLetter(createMessage(otherUUID, "people"), errors.New("writer unavailable")))
+
+	ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""), client: &http.Client{}}
+	r := adminRouter(&deadLetterHandler{store: store, ing: ing})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/__dead-letters/replay?type=organisations", nil))
+
+	var result replayResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, result.Replayed, 1)
+	assert.Empty(t, result.Failed)
+	assert.Equal(t, []string{"/organisations/" + uuid}, paths)
+
+	remaining, _ := store.List(deadLetterFilter{})
+	require.Len(t, remaining, 1)
+	assert.Equal(t, otherUUID, remaining[0].Headers["Message-Id"])
+}
+
+func TestFailedReplayKeepsTheDeadLetter(t *testing.T) {
+	store := newMemoryDeadLetterStore(10, nil)
+	store.Send(newDeadLetter(createMessage(uuid, invalidMessageType), errors.New("No configured writer for concept: animals")))
+
+	ing := ingesterService{routes: mustRoutingTable(correctWriterMappings, ""), client: &http.Client{}}
+	r := adminRouter(&deadLetterHandler{store: store, ing: ing})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/__dead-letters/replay", nil))
+
+	var result replayResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Empty(t, result.Replayed)
+	assert.Len(t, result.Failed, 1)
+
+	remaining, _ := store.List(deadLetterFilter{})
+	assert.Len(t, remaining, 1)
+}
+
+func TestMemoryDeadLetterStoreKeepsTheMostRecentDeadLetters(t *testing.T) {
+	next := &mockDeadLetterSink{}
+	store := newMemoryDeadLetterStore(2, next)
+	for _, id := range []string{"first", "second", "third"} {
+		store.Send(deadLetter{ID: id})
+	}
+
+	kept, _ := store.List(deadLetterFilter{})
+	assert.Equal(t, []deadLetter{{ID: "second"}, {ID: "third"}}, kept)
+	assert.Len(t, next.deadLetters, 3, "Every dead letter should be forwarded")
+}
+
+func adminRouter(h adminHandler) *mux.Router {
+	r := mux.NewRouter()
+	h.registerHandlers(r)
+	return r
+}
+
+func TestConcurrentReplaysReplayEachDeadLetterOnce(t *testing.T) {
+	var mu sync.Mutex
+	writes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	store := newMemoryDeadLetterStore(10, nil)
+	store.Send(newDeadLetter(createMessage(uuid, validMessageTypeOrganisations), errors.New("writer unavailable")))
+	ing := ingesterService{routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""), client: &http.Client{}}
+	r := adminRouter(&deadLetterHandler{store: store, ing: ing})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/__dead-letters/replay", nil))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, writes, "A dead letter should only be replayed once")
+	remaining, _ := store.List(deadLetterFilter{})
+	assert.Empty(t, remaining)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// retryPolicy controls how many times a call to a writer is attempted before the message is given up on.
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	// jitter is the fraction (0 to 1) of each backoff that is randomised, so that consumers don't retry in lockstep.
+	jitter float64
+}
+
+// do calls send until it succeeds, returns an error that is not worth retrying, or the attempts are exhausted.
+// Each retry marks the meter with the given name. No more attempts are made once ctx is done.
+func (p retryPolicy) do(ctx context.Context, meterName string, send func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = send()
+		if err == nil || !isTransient(err) || attempt >= p.maxAttempts {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		retryMeter := metrics.GetOrRegisterMeter(meterName, metrics.DefaultRegistry)
+		retryMeter.Mark(1)
+		log.Warnf("Attempt %d of %d failed, retrying in %v: %v", attempt, p.maxAttempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			log.Warnf("Giving up after attempt %d of %d: %v", attempt, p.maxAttempts, ctx.Err())
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.baseBackoff << uint(attempt-1)
+	if backoff <= 0 || (p.maxBackoff > 0 && backoff > p.maxBackoff) {
+		backoff = p.maxBackoff
+	}
+	if p.jitter > 0 {
+		backoff -= time.Duration(p.jitter * rand.Float64() * float64(backoff))
+	}
+	return backoff
+}
+
+// isTransient reports whether a failed writer call might succeed if it was tried again.
+// Connection errors, 429s and 5xx responses are transient; anything else (e.g. a 400 for an invalid concept) is not.
+func isTransient(err error) bool {
+	wErr, ok := err.(*writerError)
+	if !ok {
+		return false
+	}
+	return wErr.status == 0 || wErr.status == http.StatusTooManyRequests || wErr.status >= http.StatusInternalServerError
+}
+
+// isPermanent reports whether a writer rejected the message, so that it would fail however often it was tried again.
+// Unlike the errors that are not transient, an open circuit breaker or a missing route may yet clear up.
+func isPermanent(err error) bool {
+	_, ok := err.(*writerError)
+	return ok && !isTransient(err)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransientWriterFailuresAreRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	retryMeterInitialCount := getRetryCount()
+	successMeterInitialCount, failureMeterInitialCount := getCounts()
+
+	ing := ingesterService{
+		routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client: &http.Client{},
+		retry:  retryPolicy{maxAttempts: 3, baseBackoff: time.Millisecond, maxBackoff: 5 * time.Millisecond},
+	}
+
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert := assert.New(t)
+	assert.NoError(err, "Should succeed on the third attempt")
+	assert.Equal(3, calls)
+
+	successMeterFinalCount, failureMeterFinalCount := getCounts()
+	assert.Equal(int64(2), getRetryCount()-retryMeterInitialCount, "Should have incremented RetryCount by 2")
+	assert.Equal(int64(1), successMeterFinalCount-successMeterInitialCount, "Should have incremented SuccessCount by 1")
+	assert.Equal(int64(0), failureMeterFinalCount-failureMeterInitialCount, "Should not have incremented FailureCount")
+}
+
+func TestValidationFailuresAreNotRetried(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	retryMeterInitialCount := getRetryCount()
+
+	ing := ingesterService{
+		routes: mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client: &http.Client{},
+		retry:  retryPolicy{maxAttempts: 3, baseBackoff: time.Millisecond},
+	}
+
+	_, err := ing.processMessage(context.Background(), createMessage(uuid, validMessageTypeOrganisations))
+
+	assert := assert.New(t)
+	assert.Error(err, "Should error")
+	assert.Equal(1, calls, "A 400 should not be retried")
+	assert.Equal(int64(0), getRetryCount()-retryMeterInitialCount, "Should not have incremented RetryCount")
+}
+
+func TestRetriesStopAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	err := retryPolicy{maxAttempts: 4}.do(context.Background(), "test-RETRY", func() error {
+		calls++
+		return &writerError{status: http.StatusTooManyRequests}
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 4, calls)
+}
+
+func TestTransientErrorClassification(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(isTransient(&writerError{err: errors.New("connection refused")}), "Connection errors are transient")
+	assert.True(isTransient(&writerError{status: http.StatusTooManyRequests}), "429 is transient")
+	assert.True(isTransient(&writerError{status: http.StatusBadGateway}), "5xx is transient")
+	assert.False(isTransient(&writerError{status: http.StatusBadRequest}), "400 is not transient")
+	assert.False(isTransient(&writerError{status: http.StatusNotFound}), "404 is not transient")
+	assert.False(isTransient(errors.New("cannot create request")), "Other errors are not transient")
+}
+
+func TestBackoffIsCappedAndJittered(t *testing.T) {
+	p := retryPolicy{baseBackoff: 100 * time.Millisecond, maxBackoff: time.Second, jitter: 0.5}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := p.backoff(attempt)
+		assert.True(t, backoff <= time.Second, "Backoff should never exceed the maximum")
+		assert.True(t, backoff >= 50*time.Millisecond, "Jitter should take at most half of the backoff")
+	}
+}
+
+func getRetryCount() int64 {
+	return metrics.GetOrRegisterMeter("organisations-RETRY", metrics.DefaultRegistry).Count()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRoute = "default"
+	// neo4jDestination is the name of the destination built from the services list.
+	// Its meters keep the names they had before destinations were configurable, e.g. organisations-FAILURE.
+	neo4jDestination         = "neo4j"
+	elasticsearchDestination = "elasticsearch"
+)
+
+// destination is one place a concept of a given type is delivered to.
+type destination struct {
+	Name string `json:"name"`
+	// URLTemplate is the URL the concept is sent to. {type} and {uuid} are replaced with the message type and concept uuid.
+	URLTemplate string `json:"url"`
+	Method      string `json:"method"`
+	// Required destinations must accept the concept for the message to succeed; failures of the others are only metered.
+	Required bool `json:"required"`
+	// HealthURL is the base URL whose /__gtg is checked. It defaults to the scheme and host of the URL template.
+	HealthURL string `json:"healthUrl"`
+	// DeleteURLTemplate is the URL a DELETE is sent to when the concept is deleted. It defaults to the URL template.
+	DeleteURLTemplate string `json:"deleteUrl"`
+	// BulkURLTemplate is the bulk endpoint concepts are batched to when bulk writes are enabled. {type} is replaced with the message type.
+	BulkURLTemplate string `json:"bulkUrl"`
+	// After lists the destinations of the same route that must succeed before this one is tried.
+	After []string `json:"after"`
+	// TimeoutMs bounds the whole delivery to the destination, retries included. It defaults to --writer-timeout-ms.
+	TimeoutMs int `json:"timeoutMs"`
+	// AttemptTimeoutMs bounds each call to the destination. It defaults to --writer-attempt-timeout-ms.
+	AttemptTimeoutMs int `json:"attemptTimeoutMs"`
+}
+
+func (d destination) url(ingestionType string, uuid string) string {
+	return strings.NewReplacer("{type}", ingestionType, "{uuid}", uuid).Replace(d.URLTemplate)
+}
+
+func (d destination) deleteURL(ingestionType string, uuid string) string {
+	if d.DeleteURLTemplate == "" {
+		return d.url(ingestionType, uuid)
+	}
+	return strings.NewReplacer("{type}", ingestionType, "{uuid}", uuid).Replace(d.DeleteURLTemplate)
+}
+
+func (d destination) bulkURL(ingestionType string) string {
+	return strings.Replace(d.BulkURLTemplate, "{type}", ingestionType, -1)
+}
+
+func (d destination) timeout(defaultTimeout time.Duration) time.Duration {
+	if d.TimeoutMs > 0 {
+		return time.Duration(d.TimeoutMs) * time.Millisecond
+	}
+	return defaultTimeout
+}
+
+func (d destination) attemptTimeout(defaultTimeout time.Duration) time.Duration {
+	if d.AttemptTimeoutMs > 0 {
+		return time.Duration(d.AttemptTimeoutMs) * time.Millisecond
+	}
+	return defaultTimeout
+}
+
+func (d destination) meterName(ingestionType string, outcome string) string {
+	if d.Name == neo4jDestination {
+		return ingestionType + "-" + outcome
+	}
+	return ingestionType + "-" + d.Name + "-" + outcome
+}
+
+func (d *destination) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("Destination with url %q has no name", d.URLTemplate)
+	}
+	if d.Method == "" {
+		d.Method = "PUT"
+	}
+	d.Method = strings.ToUpper(d.Method)
+	if d.Method != "PUT" && d.Method != "POST" && d.Method != "PATCH" {
+		return fmt.Errorf("Destination %s has unsupported method %s", d.Name, d.Method)
+	}
+	u, err := url.Parse(d.url("type", "uuid"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Destination %s has invalid url %q", d.Name, d.URLTemplate)
+	}
+	if d.HealthURL == "" {
+		d.HealthURL = u.Scheme + "://" + u.Host
+	}
+	if d.TimeoutMs < 0 || d.AttemptTimeoutMs < 0 {
+		return fmt.Errorf("Destination %s has a negative timeout", d.Name)
+	}
+	return nil
+}
+
+// routingTable decides which destinations each message type is delivered to.
+// Exact routes are tried first, then glob and regex routes in the order they were configured, then the default route.
+type routingTable struct {
+	exact        map[string][]destination
+	patterns     []routePattern
+	defaultRoute []destination
+}
+
+type routePattern struct {
+	rule         string
+	matches      func(ingestionType string) bool
+	destinations []destination
+}
+
+func newEmptyRoutingTable() *routingTable {
+	return &routingTable{exact: make(map[string][]destination)}
+}
+
+// addRoute adds a route for a rule, which is a message type, glob:<pattern>, regex:<expression> or default.
+func (rt *routingTable) addRoute(rule string, destinations []destination) error {
+	switch {
+	case rule == defaultRoute:
+		if rt.defaultRoute != nil {
+			return fmt.Errorf("More than one default route configured")
+		}
+		rt.defaultRoute = destinations
+	case strings.HasPrefix(rule, "glob:"):
+		pattern := strings.TrimPrefix(rule, "glob:")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid glob in route %q: %v", rule, err)
+		}
+		return rt.addPattern(routePattern{
+			rule:         rule,
+			matches:      func(ingestionType string) bool { ok, _ := path.Match(pattern, ingestionType); return ok },
+			destinations: destinations,
+		})
+	case strings.HasPrefix(rule, "regex:"):
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(rule, "regex:") + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid regex in route %q: %v", rule, err)
+		}
+		return rt.addPattern(routePattern{rule: rule, matches: re.MatchString, destinations: destinations})
+	default:
+		if _, ok := rt.exact[rule]; ok {
+			return fmt.Errorf("Message type %s is routed more than once", rule)
+		}
+		rt.exact[rule] = destinations
+	}
+	return nil
+}
+
+func (rt *routingTable) addPattern(p routePattern) error {
+	for _, existing := range rt.patterns {
+		if existing.rule == p.rule {
+			return fmt.Errorf("Route %q is configured more than once", p.rule)
+		}
+	}
+	rt.patterns = append(rt.patterns, p)
+	return nil
+}
+
+// newRoutingTable builds the routing table for the writers in the services list.
+// Every writer gets an exact route for the message type derived from its name (e.g. people-rw-neo4j receives people).
+// routes is a comma separated list of rule=writer pairs that adds to or overrides those, where writer is one of the
+// configured writers. If an elasticsearch writer URL is given, every route also delivers to it, optionally only once
+// neo4j has succeeded. Ambiguous routes and routes to writers that are not configured are rejected.
+func newRoutingTable(writerMappings map[string]string, routes string, elasticWriterURL string, elasticsearchAfterNeo4j bool) (*routingTable, error) {
+	rt := newEmptyRoutingTable()
+	// the writer's health and delete endpoints are not part of the bulk API
+	elasticBaseURL := strings.TrimSuffix(elasticWriterURL, "/bulk")
+	destinationsFor := func(writerURL string) []destination {
+		destinations := []destination{{Name: neo4jDestination, URLTemplate: writerURL + "/{type}/{uuid}", Method: "PUT", Required: true, HealthURL: writerURL}}
+		if elasticWriterURL != "" {
+			elasticsearch := destination{
+				Name:              elasticsearchDestination,
+				URLTemplate:       elasticWriterURL + "/{type}/{uuid}",
+				Method:            "PUT",
+				Required:          true,
+				HealthURL:         elasticBaseURL,
+				DeleteURLTemplate: elasticBaseURL + "/{type}/{uuid}",
+				BulkURLTemplate:   elasticWriterURL + "/{type}",
+			}
+			if elasticsearchAfterNeo4j {
+				elasticsearch.After = []string{neo4jDestination}
+			}
+			destinations = append(destinations, elasticsearch)
+		}
+		return destinations
+	}
+
+	derived := make(map[string][]string)
+	for service := range writerMappings {
+		ingestionType := conceptTypeForService(service)
+		derived[ingestionType] = append(derived[ingestionType], service)
+	}
+
+	for _, route := range splitRoutes(routes) {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid route %q, expected rule=writer", route)
+		}
+		rule, service := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		writerURL, ok := writerMappings[service]
+		if !ok {
+			return nil, fmt.Errorf("Route %q points to writer %s, which is not configured", route, service)
+		}
+		if err := rt.addRoute(rule, destinationsFor(writerURL)); err != nil {
+			return nil, err
+		}
+	}
+
+	for ingestionType, services := range derived {
+		if _, ok := rt.exact[ingestionType]; ok {
+			continue
+		}
+		if len(services) > 1 {
+			sort.Strings(services)
+			return nil, fmt.Errorf("Message type %s is ambiguous between writers %s, add an explicit route for it", ingestionType, strings.Join(services, ", "))
+		}
+		rt.exact[ingestionType] = destinationsFor(writerMappings[services[0]])
+	}
+
+	return rt, nil
+}
+
+type routingConfig struct {
+	Routes []struct {
+		MessageType  string        `json:"messageType"`
+		Destinations []destination `json:"destinations"`
+	} `json:"routes"`
+}
+
+// loadRoutingConfig reads a routing table from a JSON file of the form
+// {"routes": [{"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "http://organisations-rw-neo4j:8080/{type}/{uuid}", "required": true}]}]}
+// where messageType takes the same rules as the --routes option.
+func loadRoutingConfig(filename string) (*routingTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config routingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Cannot parse routing config %s: %v", filename, err)
+	}
+
+	rt := newEmptyRoutingTable()
+	for _, route := range config.Routes {
+		if route.MessageType == "" {
+			return nil, fmt.Errorf("Route without a messageType in %s", filename)
+		}
+		if len(route.Destinations) == 0 {
+			return nil, fmt.Errorf("Route %s has no destinations", route.MessageType)
+		}
+		names := make(map[string]bool)
+		for i := range route.Destinations {
+			d := &route.Destinations[i]
+			if err := d.validate(); err != nil {
+				return nil, fmt.Errorf("Route %s: %v", route.MessageType, err)
+			}
+			if names[d.Name] {
+				return nil, fmt.Errorf("Route %s has more than one destination called %s", route.MessageType, d.Name)
+			}
+			for _, after := range d.After {
+				if !names[after] {
+					return nil, fmt.Errorf("Route %s: destination %s can only come after destinations listed before it, not %s", route.MessageType, d.Name, after)
+				}
+			}
+			names[d.Name] = true
+		}
+		if err := rt.addRoute(route.MessageType, route.Destinations); err != nil {
+			return nil, err
+		}
+	}
+	return rt, nil
+}
+
+// resolve returns the destinations for the message type.
+func (rt *routingTable) resolve(ingestionType string) ([]destination, error) {
+	if destinations, ok := rt.exact[ingestionType]; ok {
+		return destinations, nil
+	}
+	for _, p := range rt.patterns {
+		if p.matches(ingestionType) {
+			return p.destinations, nil
+		}
+	}
+	if rt.defaultRoute != nil {
+		return rt.defaultRoute, nil
+	}
+	return nil, fmt.Errorf("No configured writer for concept: %v", ingestionType)
+}
+
+// healthURLs returns the distinct health URLs of every destination in the table.
+func (rt *routingTable) healthURLs() []string {
+	return rt.collectHealthURLs(func(d destination) bool { return true })
+}
+
+// requiredHealthURLs returns the distinct health URLs of the required destinations in the table.
+func (rt *routingTable) requiredHealthURLs() []string {
+	return rt.collectHealthURLs(func(d destination) bool { return d.Required })
+}
+
+func (rt *routingTable) collectHealthURLs(include func(d destination) bool) []string {
+	unique := make(map[string]bool)
+	rt.each(func(rule string, destinations []destination) {
+		for _, d := range destinations {
+			if include(d) {
+				unique[d.HealthURL] = true
+			}
+		}
+	})
+	URLs := make([]string, 0, len(unique))
+	for u := range unique {
+		URLs = append(URLs, u)
+	}
+	sort.Strings(URLs)
+	return URLs
+}
+
+// each calls f for every route, exact routes first in alphabetical order, then the patterns and the default.
+func (rt *routingTable) each(f func(rule string, destinations []destination)) {
+	types := make([]string, 0, len(rt.exact))
+	for ingestionType := range rt.exact {
+		types = append(types, ingestionType)
+	}
+	sort.Strings(types)
+	for _, ingestionType := range types {
+		f(ingestionType, rt.exact[ingestionType])
+	}
+	for _, p := range rt.patterns {
+		f(p.rule, p.destinations)
+	}
+	if rt.defaultRoute != nil {
+		f(defaultRoute, rt.defaultRoute)
+	}
+}
+
+func (rt *routingTable) logRoutes() {
+	rt.each(func(rule string, destinations []destination) {
+		for _, d := range destinations {
+			log.Infof("Routing %s to %s: %s %s (required=%t, after=%v)", rule, d.Name, d.Method, d.URLTemplate, d.Required, d.After)
+		}
+	})
+}
+
+// conceptTypeForService derives the message type a writer handles from its name,
+// e.g. http://organisations-rw-neo4j:8080 and organisations-rw-neo4j-blue both handle organisations.
+func conceptTypeForService(service string) string {
+	name := service
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	if i := strings.IndexAny(name, ":/"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, "-rw-"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func splitRoutes(routes string) []string {
+	var split []string
+	for _, route := range strings.Split(routes, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			split = append(split, route)
+		}
+	}
+	return split
+}
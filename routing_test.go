@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var routingWriterMappings = map[string]string{
+	"people-rw-neo4j":         "http://people-rw-neo4j:8080",
+	"special-people-rw-neo4j": "http://special-people-rw-neo4j:8080",
+	"series-rw-neo4j":         "http://series-rw-neo4j:8080",
+	"concepts-rw-neo4j":       "http://concepts-rw-neo4j:8080",
+}
+
+func TestMessageTypesAreRoutedByExactMatch(t *testing.T) {
+	routes, err := newRoutingTable(routingWriterMappings, "", "", true)
+	require.NoError(t, err)
+
+	// people used to be routed to either writer, depending on map iteration order
+	for i := 0; i < 20; i++ {
+		destinations, err := routes.resolve("people")
+		require.NoError(t, err)
+		assert.Equal(t, "http://people-rw-neo4j:8080", destinations[0].HealthURL)
+	}
+	destinations, err := routes.resolve("special-people")
+	require.NoError(t, err)
+	assert.Equal(t, "http://special-people-rw-neo4j:8080", destinations[0].HealthURL)
+
+	_, err = routes.resolve("peop")
+	assert.EqualError(t, err, "No configured writer for concept: peop", "Substrings of a writer name should not be routed")
+}
+
+func TestExplicitRoutesArePrecedenceOrdered(t *testing.T) {
+	routes, err := newRoutingTable(routingWriterMappings, "alphaville-series=series-rw-neo4j,glob:*-series=concepts-rw-neo4j,regex:brand(s)?=series-rw-neo4j,default=concepts-rw-neo4j", "", true)
+	require.NoError(t, err)
+
+	tests := []struct {
+		ingestionType     string
+		expectedWriterURL string
+	}{
+		{"alphaville-series", "http://series-rw-neo4j:8080"},
+		{"other-series", "http://concepts-rw-neo4j:8080"},
+		{"brands", "http://series-rw-neo4j:8080"},
+		{"brand", "http://series-rw-neo4j:8080"},
+		{"sub-brands", "http://concepts-rw-neo4j:8080"},
+		{"people", "http://people-rw-neo4j:8080"},
+		{"animals", "http://concepts-rw-neo4j:8080"},
+	}
+	for _, test := range tests {
+		destinations, err := routes.resolve(test.ingestionType)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedWriterURL, destinations[0].HealthURL, fmt.Sprintf("%s: routed to the wrong writer", test.ingestionType))
+	}
+}
+
+func TestExplicitRouteOverridesDerivedRoute(t *testing.T) {
+	routes, err := newRoutingTable(routingWriterMappings, "people=special-people-rw-neo4j", "", true)
+	require.NoError(t, err)
+
+	destinations, err := routes.resolve("people")
+	require.NoError(t, err)
+	assert.Equal(t, "http://special-people-rw-neo4j:8080", destinations[0].HealthURL)
+}
+
+func TestInvalidRoutesFailFast(t *testing.T) {
+	tests := []struct {
+		name           string
+		writerMappings map[string]string
+		routes         string
+		expectedError  string
+	}{
+		{"Route to a writer that is not configured", routingWriterMappings, "brands=brands-rw-neo4j", "not configured"},
+		{"Route without a writer", routingWriterMappings, "brands", "expected rule=writer"},
+		{"Message type routed twice", routingWriterMappings, "brands=series-rw-neo4j,brands=concepts-rw-neo4j", "routed more than once"},
+		{"Two default routes", routingWriterMappings, "default=series-rw-neo4j,default=concepts-rw-neo4j", "More than one default route"},
+		{"Invalid regex", routingWriterMappings, "regex:(brands=series-rw-neo4j", "Invalid regex"},
+		{"Invalid glob", routingWriterMappings, "glob:[brands=series-rw-neo4j", "Invalid glob"},
+		{"Pattern routed twice", routingWriterMappings, "glob:*s=series-rw-neo4j,glob:*s=concepts-rw-neo4j", "configured more than once"},
+		{
+			"Two writers deriving the same message type",
+			map[string]string{"people-rw-neo4j-blue": "http://blue", "people-rw-neo4j-green": "http://green"},
+			"",
+			"ambiguous between writers people-rw-neo4j-blue, people-rw-neo4j-green",
+		},
+	}
+	for _, test := range tests {
+		_, err := newRoutingTable(test.writerMappings, test.routes, "", true)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.expectedError, test.name)
+		}
+	}
+}
+
+func TestAmbiguousWritersCanBeDisambiguatedWithARoute(t *testing.T) {
+	routes, err := newRoutingTable(map[string]string{"people-rw-neo4j-blue": "http://blue", "people-rw-neo4j-green": "http://green"}, "people=people-rw-neo4j-green", "", true)
+	require.NoError(t, err)
+
+	destinations, err := routes.resolve("people")
+	require.NoError(t, err)
+	assert.Equal(t, "http://green", destinations[0].HealthURL)
+}
+
+func TestConceptTypeIsDerivedFromServiceName(t *testing.T) {
+	tests := map[string]string{
+		"http://organisations-rw-neo4j:8080": "organisations",
+		"organisations-rw-neo4j-blue":        "organisations",
+		"alphaville-series-rw-neo4j:8092":    "alphaville-series",
+		"authors":                            "authors",
+	}
+	for service, expected := range tests {
+		assert.Equal(t, expected, conceptTypeForService(service), service)
+	}
+}
+
+func TestRoutingConfigIsLoadedFromFile(t *testing.T) {
+	filename := writeRoutingConfig(t, `{"routes": [
+		{"messageType": "organisations", "destinations": [
+			{"name": "neo4j", "url": "http://organisations-rw-neo4j:8080/organisations/{uuid}", "required": true},
+			{"name": "elasticsearch", "url": "http://concept-rw-elasticsearch:8080/bulk/{type}/{uuid}", "required": true},
+			{"name": "public-concepts-cache", "url": "http://public-concepts-cache:8080/concepts/{uuid}", "method": "post", "healthUrl": "http://public-concepts-cache:8080"}
+		]},
+		{"messageType": "default", "destinations": [{"name": "neo4j", "url": "http://concepts-rw-neo4j:8080/{type}/{uuid}", "required": true}]}
+	]}`)
+	defer os.Remove(filename)
+
+	routes, err := loadRoutingConfig(filename)
+	require.NoError(t, err)
+
+	destinations, err := routes.resolve("organisations")
+	require.NoError(t, err)
+	require.Len(t, destinations, 3)
+	assert.Equal(t, "http://organisations-rw-neo4j:8080/organisations/"+uuid, destinations[0].url("organisations", uuid))
+	assert.Equal(t, "PUT", destinations[0].Method, "Method should default to PUT")
+	assert.Equal(t, "http://organisations-rw-neo4j:8080", destinations[0].HealthURL, "Health URL should default to the writer host")
+	assert.Equal(t, "http://concept-rw-elasticsearch:8080/bulk/organisations/"+uuid, destinations[1].url("organisations", uuid))
+	assert.Equal(t, "http://concept-rw-elasticsearch:8080", destinations[1].HealthURL, "The health check should not go through the bulk API")
+	assert.Equal(t, "POST", destinations[2].Method)
+	assert.False(t, destinations[2].Required)
+
+	destinations, err = routes.resolve("people")
+	require.NoError(t, err)
+	assert.Equal(t, "http://concepts-rw-neo4j:8080/people/"+uuid, destinations[0].url("people", uuid))
+
+	assert.Equal(t, []string{"http://concept-rw-elasticsearch:8080", "http://concepts-rw-neo4j:8080", "http://organisations-rw-neo4j:8080", "http://public-concepts-cache:8080"}, routes.healthURLs())
+}
+
+func TestInvalidRoutingConfigIsRejected(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		expectedError string
+	}{
+		{"Malformed JSON", `{"routes": [`, "Cannot parse routing config"},
+		{"Route without destinations", `{"routes": [{"messageType": "organisations"}]}`, "has no destinations"},
+		{"Destination without a name", `{"routes": [{"messageType": "organisations", "destinations": [{"url": "http://writer/{uuid}"}]}]}`, "has no name"},
+		{"Destination with a relative URL", `{"routes": [{"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "/{uuid}"}]}]}`, "invalid url"},
+		{"Destination with an unsupported method", `{"routes": [{"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "http://writer/{uuid}", "method": "GET"}]}]}`, "unsupported method"},
+		{
+			"Duplicate destination names",
+			`{"routes": [{"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "http://a/{uuid}"}, {"name": "neo4j", "url": "http://b/{uuid}"}]}]}`,
+			"more than one destination called neo4j",
+		},
+		{
+			"Destination after one that is listed later",
+			`{"routes": [{"messageType": "organisations", "destinations": [{"name": "elasticsearch", "url": "http://a/{uuid}", "after": ["neo4j"]}, {"name": "neo4j", "url": "http://b/{uuid}"}]}]}`,
+			"can only come after destinations listed before it",
+		},
+		{
+			"Message type routed twice",
+			`{"routes": [{"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "http://a/{uuid}"}]}, {"messageType": "organisations", "destinations": [{"name": "neo4j", "url": "http://b/{uuid}"}]}]}`,
+			"routed more than once",
+		},
+	}
+	for _, test := range tests {
+		filename := writeRoutingConfig(t, test.config)
+		_, err := loadRoutingConfig(filename)
+		os.Remove(filename)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.expectedError, test.name)
+		}
+	}
+}
+
+func TestServicesListRoutesToNeo4jAndElasticsearch(t *testing.T) {
+	routes, err := newRoutingTable(correctWriterMappings, "", "http://concept-rw-elasticsearch:8080/bulk", true)
+	require.NoError(t, err)
+
+	destinations, err := routes.resolve("organisations")
+	require.NoError(t, err)
+	require.Len(t, destinations, 2)
+	assert.Equal(t, neo4jDestination, destinations[0].Name)
+	assert.Equal(t, "http://organisations-rw-neo4j:8080/organisations/"+uuid, destinations[0].url("organisations", uuid))
+	assert.Equal(t, elasticsearchDestination, destinations[1].Name)
+	assert.Equal(t, "http://concept-rw-elasticsearch:8080/bulk/organisations/"+uuid, destinations[1].url("organisations", uuid))
+	assert.Equal(t, "http://concept-rw-elasticsearch:8080", destinations[1].HealthURL, "The health check should not go through the bulk API")
+	assert.Equal(t, "organisations-FAILURE", destinations[0].meterName("organisations", "FAILURE"))
+	assert.Equal(t, "organisations-elasticsearch-FAILURE", destinations[1].meterName("organisations", "FAILURE"))
+}
+
+func writeRoutingConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "routing-config")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(config)
+	require.NoError(t, err)
+	return f.Name()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// schemaValidator checks concepts against the JSON Schema for their message type before they are routed.
+type schemaValidator struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+// validationError is returned for a concept that does not match the schema for its type. It is not transient:
+// the concept is rejected rather than retried or dead-lettered.
+type validationError struct {
+	ingestionType string
+	uuid          string
+	errors        []string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("Invalid %s with uuid %s: %s", e.ingestionType, e.uuid, strings.Join(e.errors, "; "))
+}
+
+// newSchemaValidator loads a schema for each <type>.json file in the directory, e.g. organisations.json for the
+// organisations message type. Schemas can refer to other files in the directory with relative $refs.
+func newSchemaValidator(dir string) (*schemaValidator, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read schema directory %s: %v", dir, err)
+	}
+	v := &schemaValidator{schemas: make(map[string]*gojsonschema.Schema)}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(absDir, file.Name())
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schema %s: %v", path, err)
+		}
+		ingestionType := strings.TrimSuffix(file.Name(), ".json")
+		v.schemas[ingestionType] = schema
+		log.Infof("Validating %s against schema %s", ingestionType, path)
+	}
+	return v, nil
+}
+
+// validate returns a validationError if the body does not match the schema for its type. Types without a schema,
+// and every type when the validator is nil, are not checked.
+func (v *schemaValidator) validate(ingestionType string, uuid string, body string) error {
+	if v == nil {
+		return nil
+	}
+	schema, ok := v.schemas[ingestionType]
+	if !ok {
+		return nil
+	}
+	result, err := schema.Validate(gojsonschema.NewStringLoader(body))
+	if err != nil {
+		return &validationError{ingestionType: ingestionType, uuid: uuid, errors: []string{err.Error()}}
+	}
+	if result.Valid() {
+		return nil
+	}
+	vErr := &validationError{ingestionType: ingestionType, uuid: uuid}
+	for _, resultErr := range result.Errors() {
+		vErr.errors = append(vErr.errors, resultErr.String())
+	}
+	return vErr
+}
+
+// reject sends an invalid message to the rejection sink and reports whether it was set aside. Without a rejection
+// sink, or in a dry run, the message is only logged, as it would never be valid however often it was retried.
+func (ing ingesterService) reject(msg queueConsumer.Message, err error) bool {
+	ingestionType, uuid, _ := extractMessageTypeAndId(msg.Headers)
+	if ing.dryRun != nil || ing.rejections == nil {
+		log.Warnf("Dropping invalid %s with uuid: %s", ingestionType, uuid)
+		return true
+	}
+	if sinkErr := ing.rejections.Send(newDeadLetter(msg, err, ing.stale.headers()...)); sinkErr != nil {
+		log.Errorf("Cannot reject %s with uuid: %s: %v", ingestionType, uuid, sinkErr)
+		return false
+	}
+	log.Infof("Rejected %s with uuid: %s", ingestionType, uuid)
+	return true
+}
+
+func markInvalid(ingestionType string) {
+	invalidMeter := metrics.GetOrRegisterMeter(ingestionType+"-INVALID", metrics.DefaultRegistry)
+	invalidMeter.Mark(1)
+	log.Infof("Incremented invalid count, new count=%d for meter=%s", invalidMeter.Count(), ingestionType+"-INVALID")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const organisationsSchema = `{
+	"type": "object",
+	"required": ["uuid", "prefLabel"],
+	"properties": {
+		"uuid": {"type": "string"},
+		"prefLabel": {"type": "string"}
+	}
+}`
+
+func newTestSchemaValidator(t *testing.T) *schemaValidator {
+	dir, err := ioutil.TempDir("", "schemas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "organisations.json"), []byte(organisationsSchema), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a schema"), 0644))
+
+	v, err := newSchemaValidator(dir)
+	require.NoError(t, err)
+	return v
+}
+
+func TestSchemaValidation(t *testing.T) {
+	v := newTestSchemaValidator(t)
+
+	assert.NoError(t, v.validate("organisations", uuid, `{"uuid": "`+uuid+`", "prefLabel": "FT"}`))
+	assert.NoError(t, v.validate("brands", uuid, `{}`), "Types without a schema should not be validated")
+	var none *schemaValidator
+	assert.NoError(t, none.validate("organisations", uuid, `{}`), "Nothing should be validated without schemas")
+
+	err := v.validate("organisations", uuid, `{"uuid": 1}`)
+	require.IsType(t, &validationError{}, err)
+	assert.Len(t, err.(*validationError).errors, 2)
+
+	err = v.validate("organisations", uuid, `{transformed-org-json`)
+	require.IsType(t, &validationError{}, err, "A body that is not JSON should be invalid")
+}
+
+func TestInvalidSchemaIsAnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "organisations.json"), []byte(`{"type": `), 0644))
+
+	_, err = newSchemaValidator(dir)
+	assert.Error(t, err)
+
+	_, err = newSchemaValidator(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestInvalidMessageIsRejectedNotDeadLettered(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	rejections := &mockDeadLetterSink{}
+	deadLetters := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:      mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:      &http.Client{},
+		schemas:     newTestSchemaValidator(t),
+		rejections:  rejections,
+		deadLetters: deadLetters,
+	}
+	invalidCount := getInvalidCount()
+	_, failureCount := getCounts()
+
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Body = `{"uuid": "` + uuid + `"}`
+	assert.NoError(t, ing.handleMessage(context.Background(), msg))
+
+	assert.False(t, called, "An invalid concept should not be sent to the writers")
+	assert.Empty(t, deadLetters.deadLetters)
+	require.Len(t, rejections.deadLetters, 1)
+	assert.Equal(t, msg.Body, rejections.deadLetters[0].Body)
+	require.Len(t, rejections.deadLetters[0].ValidationErrors, 1)
+	assert.Contains(t, rejections.deadLetters[0].ValidationErrors[0], "prefLabel")
+	assert.Equal(t, int64(1), getInvalidCount()-invalidCount)
+	_, failureCountAfter := getCounts()
+	assert.Equal(t, failureCount, failureCountAfter, "Invalid concepts should not count as writer failures")
+}
+
+func TestDeletesAreNotValidated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:  mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:  &http.Client{},
+		schemas: newTestSchemaValidator(t),
+		deletes: deleteDetector{typeSuffix: "-deleted"},
+	}
+	msg := createMessage(uuid, "organisations-deleted")
+	msg.Body = ""
+
+	_, err := ing.processMessage(context.Background(), msg)
+	assert.NoError(t, err)
+}
+
+func getInvalidCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-INVALID", metrics.DefaultRegistry).Count()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inFlightMessages keeps track of the messages being processed, so that shutdown can wait for them
+// and report the ones it could not wait for.
+type inFlightMessages struct {
+	mu       sync.Mutex
+	next     int
+	messages map[int]string
+}
+
+func newInFlightMessages() *inFlightMessages {
+	return &inFlightMessages{messages: make(map[int]string)}
+}
+
+// add records a message as in flight until the returned function is called. A nil inFlightMessages records nothing.
+func (f *inFlightMessages) add(ingestionType string, uuid string) func() {
+	if f == nil {
+		return func() {}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.next
+	f.next++
+	f.messages[id] = ingestionType + " " + uuid
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.messages, id)
+	}
+}
+
+func (f *inFlightMessages) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages := make([]string, 0, len(f.messages))
+	for _, msg := range f.messages {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+// wait waits until no messages are in flight or the deadline passes, and returns the messages still in flight.
+func (f *inFlightMessages) wait(deadline time.Time) []string {
+	for {
+		remaining := f.list()
+		if len(remaining) == 0 || !time.Now().Before(deadline) {
+			return remaining
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shutdown stops consuming, gives the messages in flight until the grace period is over to finish, sends any
+// batched writes and stops the HTTP server. Anything left unfinished is logged so it can be replayed.
+func shutdown(consumer messageSource, ing ingesterService, server *http.Server, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+
+	stopped := make(chan struct{})
+	go func() {
+		consumer.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Info("Stopped consuming")
+	case <-time.After(grace):
+		log.Warn("Consumer did not stop within the shutdown grace period")
+	}
+
+	// messages waiting for a bulk request to fill up need not wait any longer
+	if ing.bulk != nil {
+		ing.bulk.flush()
+	}
+	if queued := ing.ordering.wait(deadline); queued > 0 {
+		log.Errorf("Shutdown grace period of %v is over with %d messages still queued for the ordering workers, they may need replaying", grace, queued)
+	}
+	if held := ing.coalesce.flush(deadline); held > 0 {
+		log.Errorf("Shutdown grace period of %v is over with updates to %d concepts still held back for coalescing, they may need replaying", grace, held)
+	}
+	if unfinished := ing.inFlight.wait(deadline); len(unfinished) > 0 {
+		log.Errorf("Shutdown grace period of %v is over with %d messages unfinished, they may need replaying: %s", grace, len(unfinished), strings.Join(unfinished, ", "))
+	} else {
+		log.Info("All in-flight messages have finished")
+	}
+
+	// retries of bulk writes made while draining
+	if ing.bulk != nil {
+		ing.bulk.flush()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Unable to shut down server cleanly: %v", err)
+	}
+}
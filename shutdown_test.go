@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInFlightMessagesAreWaitedFor(t *testing.T) {
+	inFlight := newInFlightMessages()
+	done := inFlight.add(validMessageTypeOrganisations, uuid)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done()
+	}()
+
+	assert.Empty(t, inFlight.wait(time.Now().Add(time.Second)))
+}
+
+func TestUnfinishedMessagesAreReported(t *testing.T) {
+	inFlight := newInFlightMessages()
+	inFlight.add(validMessageTypeOrganisations, uuid)
+	inFlight.add("people", otherUUID)()
+
+	unfinished := inFlight.wait(time.Now().Add(20 * time.Millisecond))
+
+	assert.Equal(t, []string{"organisations " + uuid}, unfinished)
+}
+
+func TestShutdownDrainsMessagesFlushesBatchesAndStopsTheServer(t *testing.T) {
+	bs := &bulkServer{}
+	esServer := httptest.NewServer(bs)
+	defer esServer.Close()
+
+	ing := ingesterService{inFlight: newInFlightMessages(), bulk: newBulkWriter(100, time.Hour, &http.Client{})}
+	dest := destination{Name: elasticsearchDestination, BulkURLTemplate: esServer.URL + "/bulk/{type}"}
+	written := make(chan error, 1)
+	go func() {
+		defer ing.inFlight.add(validMessageTypeOrganisations, uuid)()
+		written <- ing.bulk.write(context.Background(), delivery{ingestionType: validMessageTypeOrganisations, uuid: uuid, body: `{}`}, dest)
+	}()
+	waitForBatchedItems(ing.bulk, 1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error)
+	go func() { served <- server.Serve(listener) }()
+
+	consumer := &fakeConsumer{stop: make(chan struct{})}
+	go consumer.Start()
+
+	shutdown(consumer, ing, server, time.Second)
+
+	assert.NoError(t, <-written, "The batch the message was waiting on should have been sent")
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	assert.Empty(t, ing.inFlight.list())
+	assert.Len(t, bs.requests, 1)
+}
@@ -0,0 +1,13 @@
+package main
+
+// messageSource is where the messages to ingest come from: the kafka-rest-proxy through message-queue-gonsumer or
+// the committing consumer, or the Kafka brokers directly. Each source hands its messages to the ingester until it
+// is stopped.
+type messageSource interface {
+	// Start consumes until Stop is called.
+	Start()
+	// Stop stops consuming and returns once the messages being handled have finished.
+	Stop()
+	// ConnectivityCheck reports whether the source can reach the queue, for the health check.
+	ConnectivityCheck() (string, error)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// staleUpdates tracks the publish timestamp of the last message applied to each concept, so that a message published
+// before it, e.g. a delayed replay, does not overwrite the newer concept.
+type staleUpdates struct {
+	header string
+	// deadLetter sends stale messages to the dead-letter sink rather than dropping them
+	deadLetter bool
+	store      dedupStore
+
+	// mu makes recording a timestamp atomic, so that a newer timestamp is never replaced by an older one
+	mu sync.Mutex
+}
+
+// staleError is returned for a message published before the last message applied to its concept.
+type staleError struct {
+	ingestionType string
+	uuid          string
+	published     time.Time
+	applied       time.Time
+}
+
+func (e *staleError) Error() string {
+	return fmt.Sprintf("Stale %s with uuid %s: published at %s, but an update published at %s has been applied",
+		e.ingestionType, e.uuid, e.published.Format(time.RFC3339Nano), e.applied.Format(time.RFC3339Nano))
+}
+
+func newStaleUpdates(header string, deadLetter bool, store dedupStore) *staleUpdates {
+	return &staleUpdates{header: header, deadLetter: deadLetter, store: store}
+}
+
+// headers returns the header holding the publish timestamp, which dead letters keep so that a replayed message is
+// still checked. A nil staleUpdates reads no headers.
+func (s *staleUpdates) headers() []string {
+	if s == nil {
+		return nil
+	}
+	return []string{s.header}
+}
+
+func staleKey(d delivery) string {
+	return d.ingestionType + "/" + d.uuid
+}
+
+// published reads the publish timestamp of a message. Messages without a valid timestamp are not checked.
+func (s *staleUpdates) published(d delivery, headers map[string]string) (time.Time, bool) {
+	value, ok := headers[s.header]
+	if !ok {
+		return time.Time{}, false
+	}
+	published, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		log.Warnf("Invalid %s header %q for %s with uuid: %s: %v", s.header, value, d.ingestionType, d.uuid, err)
+		return time.Time{}, false
+	}
+	return published, true
+}
+
+func (s *staleUpdates) applied(d delivery) (time.Time, bool) {
+	value, ok, err := s.store.Get(staleKey(d))
+	if err != nil {
+		log.Warnf("Cannot read the last applied timestamp of %s with uuid: %s: %v", d.ingestionType, d.uuid, err)
+		return time.Time{}, false
+	}
+	if !ok {
+		return time.Time{}, false
+	}
+	applied, err := time.Parse(time.RFC3339Nano, value)
+	return applied, err == nil
+}
+
+// check returns a staleError if the message was published before the last message applied to its concept. A nil
+// staleUpdates finds nothing stale.
+func (s *staleUpdates) check(d delivery, headers map[string]string) *staleError {
+	if s == nil {
+		return nil
+	}
+	published, ok := s.published(d, headers)
+	if !ok {
+		return nil
+	}
+	applied, ok := s.applied(d)
+	if !ok || !published.Before(applied) {
+		return nil
+	}
+	staleMeter := metrics.GetOrRegisterMeter(d.ingestionType+"-STALE", metrics.DefaultRegistry)
+	staleMeter.Mark(1)
+	log.Infof("Incremented stale count, new count=%d for meter=%s", staleMeter.Count(), d.ingestionType+"-STALE")
+	return &staleError{ingestionType: d.ingestionType, uuid: d.uuid, published: published, applied: applied}
+}
+
+// record remembers the publish timestamp of a message that was applied, unless a later one was applied first. A nil
+// staleUpdates records nothing.
+func (s *staleUpdates) record(d delivery, headers map[string]string) {
+	if s == nil {
+		return
+	}
+	published, ok := s.published(d, headers)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if applied, ok := s.applied(d); ok && applied.After(published) {
+		return
+	}
+	if err := s.store.Put(staleKey(d), published.Format(time.RFC3339Nano)); err != nil {
+		log.Warnf("Cannot record the last applied timestamp of %s with uuid: %s: %v", d.ingestionType, d.uuid, err)
+	}
+}
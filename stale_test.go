@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	queueConsumer "github.com/Financial-Times/message-queue-gonsumer/consumer"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishedAt(msg queueConsumer.Message, timestamp string) queueConsumer.Message {
+	headers := make(map[string]string, len(msg.Headers))
+	for header, value := range msg.Headers {
+		headers[header] = value
+	}
+	headers["Message-Timestamp"] = timestamp
+	msg.Headers = headers
+	return msg
+}
+
+func TestStaleUpdatesAreDropped(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	ing := ingesterService{
+		routes:  mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:  &http.Client{},
+		deletes: deleteDetector{typeSuffix: "-deleted"},
+		stale:   newStaleUpdates("Message-Timestamp", false, newMemoryDedupStore(time.Hour, 100)),
+	}
+	staleCount := getStaleCount()
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	deleted := createMessage(uuid, "organisations-deleted")
+	deleted.Body = ""
+
+	for i, step := range []struct {
+		msg   queueConsumer.Message
+		calls int
+	}{
+		{publishedAt(msg, "2016-06-16T08:14:36.910Z"), 1},
+		{publishedAt(msg, "2016-06-16T08:14:36.909Z"), 1},
+		{publishedAt(deleted, "2016-06-16T08:00:00Z"), 1},
+		{publishedAt(msg, "2016-06-16T08:14:36.910Z"), 2},
+		{publishedAt(msg, "not a timestamp"), 3},
+		{publishedAt(deleted, "2016-06-16T10:00:00+01:00"), 4},
+		{publishedAt(createMessage(otherUUID, validMessageTypeOrganisations), "2016-06-16T08:00:00Z"), 5},
+	} {
+		_, err := ing.processMessage(context.Background(), step.msg)
+		require.NoError(t, err, "Message %d", i)
+		assert.Equal(t, step.calls, calls, "Writer calls after message %d", i)
+	}
+	assert.Equal(t, int64(2), getStaleCount()-staleCount)
+}
+
+func TestStaleUpdatesCanBeDeadLettered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sink := &mockDeadLetterSink{}
+	ing := ingesterService{
+		routes:      mustRoutingTable(map[string]string{"organisations-rw-neo4j": server.URL}, ""),
+		client:      &http.Client{},
+		deadLetters: sink,
+		stale:       newStaleUpdates("X-Published", true, newMemoryDedupStore(time.Hour, 100)),
+	}
+	msg := createMessage(uuid, validMessageTypeOrganisations)
+	msg.Headers = map[string]string{"Message-Type": validMessageTypeOrganisations, "Message-Id": uuid, "X-Published": "2016-06-16T08:14:36Z"}
+	require.NoError(t, ing.handleMessage(context.Background(), msg))
+
+	msg.Headers = map[string]string{"Message-Type": validMessageTypeOrganisations, "Message-Id": uuid, "X-Published": "2016-06-16T08:00:00Z"}
+	require.NoError(t, ing.handleMessage(context.Background(), msg))
+
+	require.Len(t, sink.deadLetters, 1)
+	assert.Contains(t, sink.deadLetters[0].Error, "Stale organisations")
+	assert.Equal(t, "2016-06-16T08:00:00Z", sink.deadLetters[0].Headers["X-Published"], "The dead letter should keep its publish timestamp")
+}
+
+func getStaleCount() int64 {
+	return metrics.GetOrRegisterMeter(validMessageTypeOrganisations+"-STALE", metrics.DefaultRegistry).Count()
+}